@@ -1,29 +1,62 @@
 // 动态、易变、低风险数据存放于redis
 // 固定key，使用INCR生成自增的MSGID
 // 请求方自定义key，在一段时间内保存消息的特殊标记
-// 固定key，使用LIST作为广播消息队列
+// 固定key，使用LIST作为广播消息队列，也可以按队列名切换为STREAM以支持消费组
 // 固定key，使用HASH保存消息的Ack信息
 // 固定key，使用ZSET保存群组消息ID和它的生命周期，用户收到群组消息后，使用SET做标记
 // 用户ID为key，使用ZSET保存用户消息ID和它的生存周期，用户收到消息后，从ZSET中删除
 // DeviceKey为key，使用ZSET保存设备消息ID和它的生存周期，设备收到消息后，从ZSET中删除
 // 当使用ZSET时以精确到毫秒的int64时间为scroe，如20060102150405999, 在特殊情况下score=0
+// score的格式由ScoreCodec决定，UseScoreCodec可切换为Unix毫秒数
+// 以上key都由KeyScheme构造，默认沿用旧的无前缀方案，UseKeyScheme切换为带前缀的方案
 package MsgStore
 
 import (
 	"fmt"
-	"github.com/6xiao/go/Common"
 	"github.com/garyburd/redigo/redis"
+	"sync"
 	"time"
 )
 
 type Redis struct {
 	pool *redis.Pool
+
+	// 使用STREAM实现的广播队列及其长度上限，不在其中的队列使用LIST
+	mu      sync.RWMutex
+	streams map[string]int64
+
+	// 过期消息的后台清理
+	gc collector
+
+	// key的命名方案，dualRead为true时读操作同时读取旧方案的key
+	keys     KeyScheme
+	dualRead bool
+
+	// 存储出错时的回调
+	hook ErrorHook
+
+	// 用户消息发送历史的保留策略
+	retention HistoryRetention
+
+	// 投递统计的保留时长，0表示不自动统计
+	analytics time.Duration
+
+	// 官方消息每日限额的默认时区，nil为UTC
+	limitLoc *time.Location
+
+	// 有序集合score的编码方式，nil为PackedScores
+	codec ScoreCodec
+
+	// 是否收集过期未送达的死信及死信的保留时长
+	expired          bool
+	expiredRetention time.Duration
+
+	// 是否登记消息写入的有序集合，供RecallMsg撤回
+	recall bool
 }
 
 // 使用redis连接池，用前Get，用完Close
 func NewMutableStore(addr string, nrDb int) *Redis {
-	defer Common.CheckPanic()
-
 	pool := &redis.Pool{
 		MaxIdle:     8,
 		IdleTimeout: time.Minute,
@@ -38,352 +71,535 @@ func NewMutableStore(addr string, nrDb int) *Redis {
 		},
 	}
 
-	return &Redis{pool}
+	return &Redis{pool: pool, streams: make(map[string]int64)}
 }
 
 // redis的incr操作是原子性递增的数字，可以用来生成msgid
-func (this *Redis) NewMsgID(key string) (int64, error) {
-	defer Common.CheckPanic()
+func (this *Redis) NewMsgID(key string) (_ int64, err error) {
+	defer this.guard("NewMsgID", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	return redis.Int64(rc.Do("INCR", key))
+	return redis.Int64(rc.Do("INCR", this.Keys().MsgID(key)))
 }
 
 // 标识请求的哈希值和消息ID的映射关系
-func (this *Redis) MarkRequest(key, value string, ttl int) {
-	defer Common.CheckPanic()
+func (this *Redis) MarkRequest(key, value string, ttl int) (err error) {
+	defer this.guard("MarkRequest", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	rc.Do("SETEX", key, ttl, value)
+	_, err = rc.Do("SETEX", this.Keys().Request(key), ttl, value)
+	return err
 }
 
 // 根据哈希值查询消息ID
-func (this *Redis) GetRequest(key string) (string, error) {
+func (this *Redis) GetRequest(key string) (_ string, err error) {
 	if len(key) == 0 {
 		return "", nil
 	}
 
-	defer Common.CheckPanic()
+	defer this.guard("GetRequest", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	res, err := rc.Do("GET", key)
-	if err != nil {
-		return "", err
-	}
-	if res == nil {
-		return "", nil
+	// 迁移期间新key不存在时再查旧key
+	for _, k := range this.readKeys() {
+		res, err := rc.Do("GET", k.Request(key))
+		if err != nil {
+			return "", err
+		}
+		if res != nil {
+			return redis.String(res, nil)
+		}
 	}
 
-	return redis.String(res, nil)
+	return "", nil
 }
 
 // 广播队列，使用列表LIST
 // 新消息广播队列, 返回队列长度
-func (this *Redis) PublishNewMsg(queue string, msg []byte) (int64, error) {
+func (this *Redis) PublishNewMsg(queue string, msg []byte) (_ int64, err error) {
 	if len(queue) == 0 || len(msg) == 0 {
 		return 0, nil
 	}
 
-	defer Common.CheckPanic()
+	if maxLen, ok := this.streamQueue(queue); ok {
+		return this.publishStreamMsg(queue, maxLen, msg)
+	}
+
+	defer this.guard("PublishNewMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	return redis.Int64(rc.Do("RPUSH", queue, msg))
+	return redis.Int64(rc.Do("RPUSH", this.Keys().Queue(queue), msg))
 }
 
-// 从消息广播队列取一个消息，非阻塞，需要循环调用
-func (this *Redis) GetPublishMsg(queue string) ([]byte, error) {
+// 从消息广播队列取一个消息，非阻塞，需要循环调用，阻塞消费使用ConsumePublishMsg
+// 队列空时返回ErrQueueEmpty
+func (this *Redis) GetPublishMsg(queue string) (_ []byte, err error) {
 	if len(queue) == 0 {
-		return nil, nil
+		return nil, ErrQueueEmpty
+	}
+	if _, ok := this.streamQueue(queue); ok {
+		return nil, fmt.Errorf("queue %s is a stream, use ReadStreamMsg", queue)
 	}
 
-	defer Common.CheckPanic()
+	defer this.guard("GetPublishMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	// 返回ErrNil是因为队列空，算不上错误
-	msg, err := redis.Bytes(rc.Do("LPOP", queue))
-	if err == redis.ErrNil {
-		return nil, nil
+	// 返回ErrNil是因为队列空，迁移期间新队列空时再取旧队列
+	for _, k := range this.readKeys() {
+		msg, err := redis.Bytes(rc.Do("LPOP", k.Queue(queue)))
+		if err != redis.ErrNil {
+			return msg, err
+		}
 	}
 
-	return msg, err
+	return nil, ErrQueueEmpty
 }
 
 // 延时推送缓存，使用zset
-func (this *Redis) NewLazyMsg(set string, tm time.Time, msgid string) (int64, error) {
-	defer Common.CheckPanic()
+func (this *Redis) NewLazyMsg(set string, tm time.Time, msgid string) (_ int64, err error) {
+	defer this.guard("NewLazyMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	return redis.Int64(rc.Do("ZADD", set, Common.NumberTime(tm), msgid))
+	keys := this.Keys()
+	lazy := keys.Lazy(set)
+	n, err := redis.Int64(rc.Do("ZADD", lazy, this.score(tm), msgid))
+	if err != nil {
+		return n, err
+	}
+
+	// 投递记录保留到发送时间之后
+	ttl := int(time.Until(tm)/time.Second) + recall_TTL
+	return n, this.track(rc, msgid, lazy, targetLazy, ttl)
 }
 
-func (this *Redis) GetLazyMsg(set string) ([]string, error) {
-	defer Common.CheckPanic()
+// 获取所有到期的延时消息，不会删除，多个进程调度时使用ClaimLazyMsg或Scheduler
+func (this *Redis) GetLazyMsg(set string) (_ []string, err error) {
+	defer this.guard("GetLazyMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	return redis.Strings(rc.Do("ZRANGEBYSCORE", set, 0, Common.NumberNow()))
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.Lazy(set) })
+	return this.rangeByTime(rc, keys, time.Time{}, time.Now())
 }
 
 // 群组消息，使用有序集合ZSET，已经发送过的群消息的用户使用SET标记
 // 保存新的群组消息，返回添加成功的消息数量
-func (this *Redis) NewGroupMsg(key, msgid string, ttl int) (int64, error) {
-	defer Common.CheckPanic()
+func (this *Redis) NewGroupMsg(key, msgid string, ttl int) (_ int64, err error) {
+	defer this.guard("NewGroupMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
 	// 创建标记集合并设置其生存周期为消息周期的2倍
-	rc.Do("SADD", msgid, "0")
-	rc.Do("EXPIRE", msgid, ttl*2)
+	keys := this.Keys()
+	mark := keys.GroupMark(msgid)
+	if _, err := rc.Do("SADD", mark, "0"); err != nil {
+		return 0, err
+	}
+	if _, err := rc.Do("EXPIRE", mark, ttl*2); err != nil {
+		return 0, err
+	}
+	if err := this.markGroupOf(rc, key, msgid, ttl*2); err != nil {
+		return 0, err
+	}
 
 	// 以消息的生命终点时间为score，添加到群组消息有序集合
-	score := Common.NumberTime(time.Now().Add(time.Second * time.Duration(ttl)))
-	return redis.Int64(rc.Do("ZADD", key, score, msgid))
+	group := keys.Group(key)
+	end := time.Now().Add(time.Second * time.Duration(ttl))
+	n, err := redis.Int64(doRegistered(rc, keys.Registry(), group, "ZADD", group, this.score(end), msgid))
+	if err != nil {
+		return n, err
+	}
+	this.autoRecord(rc, msgid, EventStored)
+	if err := this.watchExpiry(rc, targetGroup, key, msgid, group, end); err != nil {
+		return n, err
+	}
+
+	return n, this.track(rc, msgid, group, targetGroup, ttl*2)
 }
 
 // 标记发送过群组消息的用户，返回标记过的数量0|1
-func (this *Redis) MarkGroupMsg(reject bool, userid int64, userFlag, msgid string) (int64, error) {
+// 群组消息已过期时返回ErrExpired，用户消息仍然会被标记
+func (this *Redis) MarkGroupMsg(reject bool, userid int64, userFlag, msgid string) (_ int64, err error) {
 	if userid > 0 {
-		defer this.MarkUserMsg(reject, userid, msgid)
+		defer func() {
+			if _, e := this.MarkUserMsg(reject, userid, msgid); err == nil {
+				err = e
+			}
+		}()
 	}
 
-	defer Common.CheckPanic()
+	defer this.guard("MarkGroupMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	// 若TTL不大于0，则该集合大限已到，不用标记了
-	ttl, err := redis.Int64(rc.Do("TTL", msgid))
-	if ttl <= 0 || err != nil {
-		return 0, err
+	// TTL检查、标记和TTL重设在服务端原子完成，迁移期间标记第一个存在的标记集合
+	// 标记集合都已过期时脚本返回-1
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.GroupMark(msgid) })
+	args := redis.Args{len(keys)}.AddFlat(keys).Add(userFlag)
+	n, err := redis.Int64(markGroupScript.Do(rc, args...))
+	if err == nil && n < 0 {
+		return 0, ErrExpired
+	}
+	if err != nil || n <= 0 {
+		return n, err
 	}
+	this.autoRecord(rc, msgid, markEvent(reject))
 
-	// 为了防止key泄露，重新设置TTL,保证它能到期删除
-	defer rc.Do("EXPIRE", msgid, ttl)
-	return redis.Int64(rc.Do("SADD", msgid, userFlag))
+	return n, this.markGroupRead(rc, userFlag, msgid)
 }
 
 // 获取用户需要发送的所有群组消息
-func (this *Redis) GetGroupMsg(key, userFlag string) ([]string, error) {
+func (this *Redis) GetGroupMsg(key, userFlag string) (_ []string, err error) {
 	if len(userFlag) == 0 {
 		return nil, nil
 	}
 
-	defer Common.CheckPanic()
+	defer this.guard("GetGroupMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	// 取所有生存期内的群组消息的ID
-	score := Common.NumberTime(time.Now())
-	msgs, err := redis.Strings(rc.Do("ZRANGEBYSCORE", key, score, "+inf"))
-	if err != nil {
-		return nil, err
+	// 取所有生存期内的群组消息的ID，并在服务端过滤掉用户收到过的
+	// 迁移期间新旧两个群组集合都要读，消息在任一方案的标记集合中都算收到过
+	schemes := this.readKeys()
+	args := redis.Args{len(schemes)}
+	for _, k := range schemes {
+		args = args.Add(k.Group(key))
+	}
+	args = args.Add(userFlag)
+	args = append(args, this.rangeArgs(time.Now(), time.Time{})...)
+	for _, k := range schemes {
+		args = args.Add(k.groupMarkPrefix())
 	}
 
-	// 统计用户没有收到过的群组消息集合
-	var ret []string
-	for _, msg := range msgs {
-		c, err := redis.Int64(rc.Do("SISMEMBER", msg, userFlag))
-		if err != nil {
-			return nil, err
-		}
+	return redis.Strings(unreadGroupScript.Do(rc, args...))
+}
 
-		if c == 0 {
-			ret = append(ret, msg)
-		}
+// 删除某等待发送的消息，key直接作为有序集合的key，只能用于旧的无前缀方案
+// 前缀方案下不同类型的key不同，不做猜测，直接返回错误
+//
+// Deprecated: 使用DeleteGroupMsg、DeleteDeviceMsg、DeleteUserMsg或CancelLazyMsg
+func (this *Redis) DeleteMsg(key, msgid string) (_ int64, err error) {
+	defer this.guard("DeleteMsg", &err)
+	if !this.Keys().legacy() {
+		return 0, fmt.Errorf("msgstore: DeleteMsg(%q) cannot tell the target kind under a prefixed key scheme, use DeleteGroupMsg, DeleteDeviceMsg, DeleteUserMsg or CancelLazyMsg", key)
 	}
 
-	return ret, nil
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return redis.Int64(rc.Do("ZREM", key, msgid))
 }
 
-// 删除某等待发送的消息
-func (this *Redis) DeleteMsg(key, msgid string) (int64, error) {
-	defer Common.CheckPanic()
+// 删除某等待发送的群组消息，返回删除的数量0|1
+func (this *Redis) DeleteGroupMsg(key, msgid string) (_ int64, err error) {
+	defer this.guard("DeleteGroupMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	return redis.Int64(rc.Do("ZREM", key, msgid))
+	return removeFromAll(rc, this.readKeysOf(func(k KeyScheme) string { return k.Group(key) }), msgid)
+}
+
+// 删除某等待发送的设备消息，与MarkDeviceMsg不同，不记录为已送达
+func (this *Redis) DeleteDeviceMsg(devicekey, msgid string) (_ int64, err error) {
+	defer this.guard("DeleteDeviceMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return removeFromAll(rc, this.readKeysOf(func(k KeyScheme) string { return k.Device(devicekey) }), msgid)
+}
+
+// 删除某等待发送的用户消息，与MarkUserMsg不同，不写入发送历史
+func (this *Redis) DeleteUserMsg(userid int64, msgid string) (_ int64, err error) {
+	defer this.guard("DeleteUserMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return removeFromAll(rc, this.readKeysOf(func(k KeyScheme) string { return k.User(userid) }), msgid)
 }
 
 // 获取某群组消息的生命周期
-func (this *Redis) IsGroupMsgExist(key, msgid string) (bool, error) {
-	defer Common.CheckPanic()
+func (this *Redis) IsGroupMsgExist(key, msgid string) (_ bool, err error) {
+	defer this.guard("IsGroupMsgExist", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	score, err := rc.Do("ZSCORE", key, msgid)
-	if err != nil {
-		return false, err
-	}
-	if score == nil {
-		return false, nil
+	for _, k := range this.readKeys() {
+		score, err := rc.Do("ZSCORE", k.Group(key), msgid)
+		if err != nil {
+			return false, err
+		}
+		if score != nil {
+			return true, nil
+		}
 	}
 
-	return true, nil
+	return false, nil
 }
 
 // 设备消息，使用有序集合ZSET
 // 保存新设备消息，返回添加成功的消息数量
-func (this *Redis) NewDeviceMsg(devicekey string, ttl int, msgid string) (int64, error) {
-	defer Common.CheckPanic()
+func (this *Redis) NewDeviceMsg(devicekey string, ttl int, msgid string) (_ int64, err error) {
+	defer this.guard("NewDeviceMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
 	// 以消息的生命终点时间为score，添加到以devicekey为键的有序集合
+	keys := this.Keys()
 	end := time.Now().Add(time.Second * time.Duration(ttl))
-	return redis.Int64(rc.Do("ZADD", devicekey, Common.NumberTime(end), msgid))
+	device := keys.Device(devicekey)
+	n, err := redis.Int64(doRegistered(rc, keys.Registry(), device, "ZADD", device, this.score(end), msgid))
+	if err != nil {
+		return n, err
+	}
+	this.autoRecord(rc, msgid, EventStored)
+	if err := this.track(rc, msgid, device, targetDevice, ttl*2); err != nil {
+		return n, err
+	}
+	if err := this.watchExpiry(rc, targetDevice, devicekey, msgid, device, end); err != nil {
+		return n, err
+	}
+
+	// 通知订阅了该设备的网关，只更新生命周期的消息不重复通知
+	if n > 0 {
+		this.notify(rc, keys.DeviceChannel(devicekey), msgid)
+	}
+
+	return n, nil
 }
 
 // 标记发送过设备消息，返回标记过的消息数量0|1
-func (this *Redis) MarkDeviceMsg(devicekey, msgid string) (int64, error) {
-	defer Common.CheckPanic()
+func (this *Redis) MarkDeviceMsg(devicekey, msgid string) (_ int64, err error) {
+	defer this.guard("MarkDeviceMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	return redis.Int64(rc.Do("ZREM", devicekey, msgid))
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.Device(devicekey) })
+	n, err := removeFromAll(rc, keys, msgid)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	this.autoRecord(rc, msgid, EventDelivered)
+
+	return n, this.trackDelivered(rc, msgid, keys)
 }
 
 // 获取未过期的待发送设备消息的ID
-func (this *Redis) GetDeviceMsg(devicekey string) ([]string, error) {
+func (this *Redis) GetDeviceMsg(devicekey string) (_ []string, err error) {
 	if len(devicekey) == 0 {
 		return nil, nil
 	}
 
-	defer Common.CheckPanic()
+	defer this.guard("GetDeviceMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	score := Common.NumberTime(time.Now())
-	return redis.Strings(rc.Do("ZRANGEBYSCORE", devicekey, score, "+inf"))
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.Device(devicekey) })
+	return this.rangeByTime(rc, keys, time.Now(), time.Time{})
 }
 
 // 用户消息，使用有序集合ZSET
 // 保存新用户消息，返回添加成功的消息数量
-func (this *Redis) NewUserMsg(userid int64, ttl int, msgid string) (int64, error) {
+func (this *Redis) NewUserMsg(userid int64, ttl int, msgid string) (_ int64, err error) {
 	if userid == 0 {
 		return 0, nil
 	}
 
-	defer Common.CheckPanic()
+	defer this.guard("NewUserMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
 	// 以消息的生命终点时间为score，添加到以用户为键的有序集合
+	keys := this.Keys()
 	end := time.Now().Add(time.Second * time.Duration(ttl))
-	return redis.Int64(rc.Do("ZADD", userid, Common.NumberTime(end), msgid))
+	user := keys.User(userid)
+	n, err := redis.Int64(doRegistered(rc, keys.Registry(), user, "ZADD", user, this.score(end), msgid))
+	if err != nil {
+		return n, err
+	}
+	this.autoRecord(rc, msgid, EventStored)
+	if err := this.track(rc, msgid, user, targetUser, ttl*2); err != nil {
+		return n, err
+	}
+	if err := this.watchExpiry(rc, targetUser, userKey(userid), msgid, user, end); err != nil {
+		return n, err
+	}
+
+	// 通知订阅了该用户的网关，只更新生命周期的消息不重复通知
+	if n > 0 {
+		this.notify(rc, keys.UserChannel(userid), msgid)
+	}
+
+	return n, nil
 }
 
 // 标记发送过用户消息，返回标记过的消息数量0|1
-func (this *Redis) MarkUserMsg(reject bool, userid int64, msgid string) (int64, error) {
-	defer Common.CheckPanic()
+func (this *Redis) MarkUserMsg(reject bool, userid int64, msgid string) (_ int64, err error) {
+	defer this.guard("MarkUserMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	score := Common.NumberTime(time.Now())
+	keys := this.Keys()
+	score := this.score(time.Now())
+	history := keys.Pushed(userid)
 	if reject {
-		rc.Do("ZADD", fmt.Sprintf("%v_rejected", userid), score, msgid)
-	} else {
-		rc.Do("ZADD", fmt.Sprintf("%v_pushed", userid), score, msgid)
+		history = keys.Rejected(userid)
+	}
+	if _, err := doRegistered(rc, keys.Registry(), history, "ZADD", history, score, msgid); err != nil {
+		return 0, err
+	}
+	if err := this.trimHistory(rc, history); err != nil {
+		return 0, err
+	}
+
+	users := this.readKeysOf(func(k KeyScheme) string { return k.User(userid) })
+	n, err := removeFromAll(rc, users, msgid)
+	if err == nil && n > 0 {
+		this.autoRecord(rc, msgid, markEvent(reject))
 	}
 
-	return redis.Int64(rc.Do("ZREM", userid, msgid))
+	return n, err
 }
 
 // 获取已发送用户消息，返回已发送、已拒绝，已超时的消息ID
-func (this *Redis) GetPushedUserMsg(userid int64) (send []string, rej []string, out []string) {
-	defer Common.CheckPanic()
+func (this *Redis) GetPushedUserMsg(userid int64) (send []string, rej []string, out []string, err error) {
+	defer this.guard("GetPushedUserMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	send, _ = redis.Strings(rc.Do("ZRANGE", fmt.Sprintf("%v_pushed", userid), 0, -1))
-	rej, _ = redis.Strings(rc.Do("ZRANGE", fmt.Sprintf("%v_rejected", userid), 0, -1))
+	pushed := this.readKeysOf(func(k KeyScheme) string { return k.Pushed(userid) })
+	rejected := this.readKeysOf(func(k KeyScheme) string { return k.Rejected(userid) })
+	users := this.readKeysOf(func(k KeyScheme) string { return k.User(userid) })
+
+	if send, err = rangeByScore(rc, pushed, "-inf", "+inf"); err != nil {
+		return nil, nil, nil, err
+	}
+	if rej, err = rangeByScore(rc, rejected, "-inf", "+inf"); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if out, err = this.rangeByTime(rc, users, time.Time{}, time.Now()); err != nil {
+		return nil, nil, nil, err
+	}
 
-	score := Common.NumberTime(time.Now())
-	out, _ = redis.Strings(rc.Do("ZRANGEBYSCORE", userid, "-inf", score))
-	return
+	return send, rej, out, nil
 }
 
 // 获取未过期的待发送用户消息的ID
-func (this *Redis) GetUserMsg(userid int64) ([]string, error) {
+func (this *Redis) GetUserMsg(userid int64) (_ []string, err error) {
 	if userid == 0 {
 		return nil, nil
 	}
 
-	defer Common.CheckPanic()
+	defer this.guard("GetUserMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	score := Common.NumberTime(time.Now())
-	return redis.Strings(rc.Do("ZRANGEBYSCORE", userid, score, "+inf"))
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.User(userid) })
+	return this.rangeByTime(rc, keys, time.Now(), time.Time{})
 }
 
 // 消息计数器,使用HASH表
 // 获取所有Ack过的消息
-func (this *Redis) GetAckedMsg(hashtable string) []string {
-	defer Common.CheckPanic()
+func (this *Redis) GetAckedMsg(hashtable string) (_ []string, err error) {
+	defer this.guard("GetAckedMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	sa, _ := redis.Strings(rc.Do("HKEYS", hashtable))
-	return sa
+	var sa []string
+	seen := make(map[string]bool)
+	for _, k := range this.readKeys() {
+		keys, err := redis.Strings(rc.Do("HKEYS", k.Ack(hashtable)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				sa = append(sa, key)
+			}
+		}
+	}
+
+	return sa, nil
 }
 
 // 增加发送过消息计数
-func (this *Redis) AddMsgAck(hashtable, msgid string) (int64, error) {
-	defer Common.CheckPanic()
+func (this *Redis) AddMsgAck(hashtable, msgid string) (_ int64, err error) {
+	defer this.guard("AddMsgAck", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	return redis.Int64(rc.Do("HINCRBY", hashtable, msgid, 1))
+	n, err := redis.Int64(rc.Do("HINCRBY", this.Keys().Ack(hashtable), msgid, 1))
+	if err == nil {
+		this.autoRecord(rc, msgid, EventAcked)
+	}
+
+	return n, err
 }
 
 // 获取计数器值
-func (this *Redis) GetMsgAck(hashtable, msgid string) int64 {
-	defer Common.CheckPanic()
+func (this *Redis) GetMsgAck(hashtable, msgid string) (_ int64, err error) {
+	defer this.guard("GetMsgAck", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	c, _ := redis.Int64(rc.Do("HGET", hashtable, msgid))
-	return c
+	// 迁移期间新旧两个计数相加，计数不存在时为0
+	var c int64
+	for _, k := range this.readKeys() {
+		n, err := redis.Int64(rc.Do("HGET", k.Ack(hashtable), msgid))
+		if err != nil && err != redis.ErrNil {
+			return 0, err
+		}
+		c += n
+	}
+
+	return c, nil
 }
 
-// 重置计数器
-func (this *Redis) ResetMsgAck(hashtable, msgid string, count int64) {
-	defer Common.CheckPanic()
+// 重置计数器，计数减去count，减到0时删除，在服务端原子完成
+func (this *Redis) ResetMsgAck(hashtable, msgid string, count int64) (err error) {
+	defer this.guard("ResetMsgAck", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	if this.GetMsgAck(hashtable, msgid) <= count {
-		rc.Do("HDEL", hashtable, msgid)
-	} else {
-		rc.Do("HINCRBY", hashtable, msgid, -count)
-	}
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.Ack(hashtable) })
+	_, err = decrFloor(rc, keys, msgid, count)
+	return err
 }
 
-// 周期性或临时性调用清理方法
+// 周期性或临时性调用清理方法，后台持续清理使用StartGC
 // 删除过期的消息，返回删除的消息数量，这个操作可能很耗时
 // 参数为过期后仍然继续存储的时间（秒）
-func (this *Redis) ClearOutDateMsg(keeptime int) (int64, error) {
-	defer Common.CheckPanic()
-	rc := this.pool.Get()
-	defer rc.Close()
+func (this *Redis) ClearOutDateMsg(keeptime int) (_ int64, err error) {
+	defer this.guard("ClearOutDateMsg", &err)
 
-	keys, err := redis.Strings(rc.Do("KEYS", "*"))
-	if err != nil {
+	// 删除之前先把过期未送达的消息收集为死信，删除期限取收集之前的时间
+	td := -1 * time.Second * time.Duration(keeptime)
+	deadline := time.Now().Add(td)
+	if _, err := this.CollectExpired(); err != nil {
 		return 0, err
 	}
 
 	var count int64
-	td := -1 * time.Second * time.Duration(keeptime)
-	score := Common.NumberTime(time.Now().Add(td))
-	for _, key := range keys {
-		c, e := redis.Int64(rc.Do("ZREMRANGEBYSCORE", key, 0, score))
-		if e == nil {
-			count += c
+	for _, k := range this.readKeys() {
+		cursor := int64(0)
+		for {
+			next, _, removed, _, err := this.collectZSets(k.Registry(), cursor, gc_BATCH, deadline)
+			if err != nil {
+				return count, err
+			}
+
+			count += removed
+			if cursor = next; cursor == 0 {
+				break
+			}
 		}
 	}
 
@@ -394,65 +610,161 @@ const limit_TM_FMT = "Limit-20060102"
 const key_OFFICIAL = "Official-"
 
 // 标记一条消息为官方消息
-func (this *Redis) MarkOfficialMsg(msgid string, ttl int64) error {
-	defer Common.CheckPanic()
+func (this *Redis) MarkOfficialMsg(msgid string, ttl int64) (err error) {
+	defer this.guard("MarkOfficialMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	_, err := rc.Do("SETEX", key_OFFICIAL+msgid, ttl*10, msgid)
+	_, err = rc.Do("SETEX", this.Keys().Official(msgid), ttl*10, msgid)
 	return err
 }
 
 // 根据MsgID判断是不是官方消息
-func (this *Redis) IsOfficialMsg(msgid string) bool {
-	defer Common.CheckPanic()
+func (this *Redis) IsOfficialMsg(msgid string) (_ bool, err error) {
+	defer this.guard("IsOfficialMsg", &err)
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	s, err := redis.String(rc.Do("GET", key_OFFICIAL+msgid))
-	return err == nil && s == msgid
+	for _, k := range this.readKeys() {
+		s, err := redis.String(rc.Do("GET", k.Official(msgid)))
+		if err != nil && err != redis.ErrNil {
+			return false, err
+		}
+		if s == msgid {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
-// 标记发送过官方消息的设备，返回标记过的数量0|1
+// 官方消息的限额同时按滑动窗口和自然日计算，规则都取自频率限制的official策略，没有配置时使用OfficialCapRules
+// 每次标记写两份记录：滑动窗口的发送记录，和设备所在时区当天的Limit-YYYYMMDD集合
+// 自然日集合也包含改用频率限制之前的标记，任一方式达到限额即为已满，不带时区的方法使用SetLimitLocation设置的默认时区
+
+// 标记发送过官方消息的设备，返回标记过的数量0|1，已达到滑动窗口限额时不标记
 func (this *Redis) MarkOfficialDevice(devicekey string) (int64, error) {
-	defer Common.CheckPanic()
+	return this.MarkOfficialDeviceIn(devicekey, nil)
+}
+
+// 按设备所在的时区标记发送过官方消息的设备，loc为nil时使用默认时区
+func (this *Redis) MarkOfficialDeviceIn(devicekey string, loc *time.Location) (_ int64, err error) {
+	defer this.guard("MarkOfficialDevice", &err)
+	ok, err := this.officialCap(devicekey, true)
+	if !ok || err != nil {
+		return 0, err
+	}
+
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	set := time.Now().Format(limit_TM_FMT)
-	defer rc.Do("EXPIRE", set, 10*24*3600)
-	return redis.Int64(rc.Do("SADD", set, devicekey))
+	if loc == nil {
+		loc = this.limitLocation()
+	}
+
+	set := this.Keys().Limit(limitDay(loc, 0))
+	if _, err := rc.Do("SADD", set, devicekey); err != nil {
+		return 0, err
+	}
+
+	_, err = rc.Do("EXPIRE", set, 10*24*3600)
+	return 1, err
+}
+
+// 判断设备能否接受下一个官方消息
+// 出错时返回true和错误，宁可少发也不多发
+func (this *Redis) FullOfficialDevice(devicekey string) (bool, error) {
+	return this.FullOfficialDeviceIn(devicekey, nil)
 }
 
-// 通过设备1天和7天收到的官方消息数量来决定它可不可以接受下一个消息
-func (this *Redis) FullOfficialDevice(devicekey string) bool {
-	defer Common.CheckPanic()
+// 按设备所在的时区判断设备能否接受下一个官方消息，loc为nil时使用默认时区
+func (this *Redis) FullOfficialDeviceIn(devicekey string, loc *time.Location) (_ bool, err error) {
+	defer this.guard("FullOfficialDevice", &err)
+	ok, err := this.officialCap(devicekey, false)
+	if !ok || err != nil {
+		return true, err
+	}
+
 	rc := this.pool.Get()
 	defer rc.Close()
 
-	tm := time.Now()
-	today := tm.Format(limit_TM_FMT)
-	count, err := redis.Int64(rc.Do("SISMEMBER", today, devicekey))
+	if loc == nil {
+		loc = this.limitLocation()
+	}
+
+	rules, err := this.capRules(rc, CapOfficial)
 	if err != nil {
-		return true
+		return true, err
+	}
+
+	// 迁移期间同一天在任一方案的集合中标记过都算收到过
+	return fullByDays(rules, func(offset int) (bool, error) {
+		for _, k := range this.readKeys() {
+			ok, err := redis.Bool(rc.Do("SISMEMBER", k.Limit(limitDay(loc, offset)), devicekey))
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	})
+}
+
+// 读操作需要读取的各个key方案下的key
+func (this *Redis) readKeysOf(key func(KeyScheme) string) []string {
+	schemes := this.readKeys()
+	keys := make([]string, 0, len(schemes))
+	for _, k := range schemes {
+		keys = append(keys, key(k))
 	}
 
-	if count > 0 {
-		return true
+	return keys
+}
+
+// 依次读取多个有序集合中score在[min, max]之间的成员，合并后去重
+func rangeByScore(rc redis.Conn, keys []string, min, max interface{}) ([]string, error) {
+	if len(keys) == 1 {
+		return redis.Strings(rc.Do("ZRANGEBYSCORE", keys[0], min, max))
 	}
 
-	for i := -1; i > -7; i-- {
-		day := tm.Add(time.Hour * 24 * time.Duration(i)).Format(limit_TM_FMT)
-		c, err := redis.Int64(rc.Do("SISMEMBER", day, devicekey))
+	var res []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		members, err := redis.Strings(rc.Do("ZRANGEBYSCORE", key, min, max))
 		if err != nil {
-			return true
+			return nil, err
 		}
 
-		count += c
-		if count >= 3 {
-			return true
+		for _, m := range members {
+			if !seen[m] {
+				seen[m] = true
+				res = append(res, m)
+			}
 		}
 	}
 
-	return false
+	return res, nil
+}
+
+// 从多个有序集合中删除成员，返回删除的数量，同一成员只计一次
+func removeFromAll(rc redis.Conn, keys []string, member string) (int64, error) {
+	var count int64
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		c, err := redis.Int64(rc.Do("ZREM", key, member))
+		if err != nil {
+			return count, err
+		}
+		count += c
+	}
+
+	if count > 1 {
+		count = 1
+	}
+
+	return count, nil
 }
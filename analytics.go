@@ -0,0 +1,244 @@
+package MsgStore
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 消息的投递统计，在Ack计数之外按小时累计每个消息和每个活动的漏斗数据
+// EnableAnalytics开启后，存储、发送、拒绝和Ack时自动计数，超时等业务方才知道的事件用RecordMsgEvent计数
+// 每个消息和每个活动各有一个总计HASH和按小时的HASH，字段为事件名，生存周期为保留时长
+
+const (
+	EventStored    = "stored"
+	EventDelivered = "delivered"
+	EventRejected  = "rejected"
+	EventExpired   = "expired"
+	EventAcked     = "acked"
+)
+
+const key_STATS = "Stats-"
+
+// 小时桶使用UTC，与服务器时区无关
+const stats_HOUR_FMT = "2006010215"
+
+// 按小时查询时最多返回的桶数量
+const stats_MAX_HOURS = 24 * 31
+
+// 消息的统计，key为前缀加msgid，按小时的统计再加:小时
+func (k KeyScheme) MsgStats(msgid string) string {
+	return k.msgStatsPrefix() + msgid
+}
+
+func (k KeyScheme) msgStatsPrefix() string {
+	if k.legacy() {
+		return key_STATS + "msg:"
+	}
+	return k.Prefix + ":stats:msg:"
+}
+
+// 活动的统计，按小时的统计再加:小时
+func (k KeyScheme) CampaignStats(campaign string) string {
+	return k.campaignStatsPrefix() + campaign
+}
+
+func (k KeyScheme) campaignStatsPrefix() string {
+	if k.legacy() {
+		return key_STATS + "campaign:"
+	}
+	return k.Prefix + ":stats:campaign:"
+}
+
+// 消息所属的活动
+func (k KeyScheme) MsgCampaign(msgid string) string {
+	if k.legacy() {
+		return key_STATS + "of:" + msgid
+	}
+	return k.join("stats:of", msgid)
+}
+
+func statsHour(tm time.Time) string {
+	return tm.UTC().Format(stats_HOUR_FMT)
+}
+
+// 累计一个事件，同时累计到消息所属的活动
+// KEYS: 消息所属活动的key
+// ARGV: msgid 事件 数量 小时 保留秒数 消息统计前缀 活动统计前缀
+var recordEventScript = redis.NewScript(1, `
+local keys = {ARGV[6] .. ARGV[1]}
+local campaign = redis.call('GET', KEYS[1])
+if campaign then
+	table.insert(keys, ARGV[7] .. campaign)
+end
+local ttl = tonumber(ARGV[5])
+for _, key in ipairs(keys) do
+	for _, k in ipairs({key, key .. ':' .. ARGV[4]}) do
+		redis.call('HINCRBY', k, ARGV[2], ARGV[3])
+		if ttl > 0 then
+			redis.call('EXPIRE', k, ttl)
+		end
+	end
+end
+return #keys
+`)
+
+// 投递漏斗
+type Funnel struct {
+	Stored    int64
+	Delivered int64
+	Rejected  int64
+	Expired   int64
+	Acked     int64
+}
+
+// 一个小时的统计，Hour为UTC整点
+type StatsPoint struct {
+	Hour time.Time
+	Funnel
+}
+
+// 开启投递统计，retention为统计数据的保留时长，0表示关闭
+func (this *Redis) EnableAnalytics(retention time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.analytics = retention
+}
+
+func (this *Redis) analyticsRetention() time.Duration {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.analytics
+}
+
+// 把消息关联到活动，之后的事件同时计入活动的统计，生存周期与统计数据相同
+func (this *Redis) SetMsgCampaign(msgid, campaign string) (err error) {
+	defer this.guard("SetMsgCampaign", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	key := this.Keys().MsgCampaign(msgid)
+	if retention := this.analyticsRetention(); retention > 0 {
+		_, err = rc.Do("SET", key, campaign, "EX", int64(retention/time.Second))
+	} else {
+		_, err = rc.Do("SET", key, campaign)
+	}
+
+	return err
+}
+
+// 累计消息的事件，不受EnableAnalytics影响
+func (this *Redis) RecordMsgEvent(msgid, event string, n int64) (err error) {
+	defer this.guard("RecordMsgEvent", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return this.recordEvent(rc, msgid, event, n)
+}
+
+func (this *Redis) recordEvent(rc redis.Conn, msgid, event string, n int64) error {
+	keys := this.Keys()
+	ttl := int64(this.analyticsRetention() / time.Second)
+	_, err := recordEventScript.Do(rc, keys.MsgCampaign(msgid), msgid, event, n, statsHour(time.Now()),
+		ttl, keys.msgStatsPrefix(), keys.campaignStatsPrefix())
+	return err
+}
+
+// 存储操作成功后自动计数，统计出错不影响存储操作的结果，错误通过ErrorHook报告
+func (this *Redis) autoRecord(rc redis.Conn, msgid, event string) {
+	this.autoRecordN(rc, msgid, event, 1)
+}
+
+// 一次计入n个事件，用于批量操作
+func (this *Redis) autoRecordN(rc redis.Conn, msgid, event string, n int64) {
+	if this.analyticsRetention() <= 0 || n <= 0 {
+		return
+	}
+
+	var err error
+	defer this.guard("RecordMsgEvent", &err)
+	err = this.recordEvent(rc, msgid, event, n)
+}
+
+func markEvent(reject bool) string {
+	if reject {
+		return EventRejected
+	}
+	return EventDelivered
+}
+
+// 消息的累计漏斗
+func (this *Redis) GetMsgFunnel(msgid string) (_ *Funnel, err error) {
+	defer this.guard("GetMsgFunnel", &err)
+	return this.getFunnel(this.Keys().MsgStats(msgid))
+}
+
+// 活动的累计漏斗
+func (this *Redis) GetCampaignFunnel(campaign string) (_ *Funnel, err error) {
+	defer this.guard("GetCampaignFunnel", &err)
+	return this.getFunnel(this.Keys().CampaignStats(campaign))
+}
+
+func (this *Redis) getFunnel(key string) (*Funnel, error) {
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	res, err := redis.Int64Map(rc.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	return funnelOf(res), nil
+}
+
+// 消息在[start, end]之间每个小时的统计，没有数据的小时各项为0
+func (this *Redis) GetMsgStats(msgid string, start, end time.Time) (_ []*StatsPoint, err error) {
+	defer this.guard("GetMsgStats", &err)
+	return this.getStats(this.Keys().MsgStats(msgid), start, end)
+}
+
+// 活动在[start, end]之间每个小时的统计
+func (this *Redis) GetCampaignStats(campaign string, start, end time.Time) (_ []*StatsPoint, err error) {
+	defer this.guard("GetCampaignStats", &err)
+	return this.getStats(this.Keys().CampaignStats(campaign), start, end)
+}
+
+// 用管道一次读取所有小时的统计，最多stats_MAX_HOURS个小时
+func (this *Redis) getStats(key string, start, end time.Time) ([]*StatsPoint, error) {
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	var points []*StatsPoint
+	for hour := start.UTC().Truncate(time.Hour); !hour.After(end) && len(points) < stats_MAX_HOURS; hour = hour.Add(time.Hour) {
+		if err := rc.Send("HGETALL", key+":"+statsHour(hour)); err != nil {
+			return nil, err
+		}
+		points = append(points, &StatsPoint{Hour: hour})
+	}
+
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+
+	for _, p := range points {
+		res, err := redis.Int64Map(rc.Receive())
+		if err != nil {
+			return nil, err
+		}
+		p.Funnel = *funnelOf(res)
+	}
+
+	return points, nil
+}
+
+func funnelOf(m map[string]int64) *Funnel {
+	return &Funnel{
+		Stored:    m[EventStored],
+		Delivered: m[EventDelivered],
+		Rejected:  m[EventRejected],
+		Expired:   m[EventExpired],
+		Acked:     m[EventAcked],
+	}
+}
@@ -0,0 +1,265 @@
+package MsgStore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 批量写入用户消息或设备消息，用于向大量用户发送同一条消息
+// 接收方按Chunk分块，每块在一个连接上用管道一次写入，效果与逐个调用NewUserMsg、NewDeviceMsg相同：
+// 写入有序集合、登记清理、记录投递、登记过期索引、通知新写入的接收方和计数
+// 一块失败不影响其他块，失败的块连同接收方一起返回，写入是幂等的，可以原样重试
+// Checkpoint为已经处理过的接收方数量，保存后通过BulkOption.Resume从中断处继续
+
+// 批量写入的接收方，Next返回false表示已结束
+type BulkIterator interface {
+	Next() (string, bool)
+}
+
+type sliceIterator struct {
+	items []string
+	pos   int
+}
+
+func (it *sliceIterator) Next() (string, bool) {
+	if it.pos >= len(it.items) {
+		return "", false
+	}
+
+	it.pos++
+	return it.items[it.pos-1], true
+}
+
+// 用字符串切片作为接收方，设备消息为devicekey，用户消息为用户ID的十进制字符串
+func BulkSlice(items []string) BulkIterator {
+	return &sliceIterator{items: items}
+}
+
+// 用用户ID切片作为接收方
+func BulkUsers(userids []int64) BulkIterator {
+	items := make([]string, len(userids))
+	for i, userid := range userids {
+		items[i] = userKey(userid)
+	}
+
+	return &sliceIterator{items: items}
+}
+
+// 批量写入的参数，零值字段使用默认值
+type BulkOption struct {
+	Chunk   int                    // 每块的接收方数量
+	Rate    int                    // 每秒最多写入的接收方数量，0表示不限速
+	Resume  int64                  // 跳过前Resume个接收方，一般为上次中断时的Checkpoint
+	OnChunk func(chunk *BulkChunk) // 每块处理完后调用，可以在其中保存Checkpoint
+}
+
+var defaultBulkOption = BulkOption{
+	Chunk: 500,
+}
+
+func (opt *BulkOption) fill() BulkOption {
+	res := defaultBulkOption
+	if opt == nil {
+		return res
+	}
+
+	if opt.Chunk > 0 {
+		res.Chunk = opt.Chunk
+	}
+	if opt.Rate > 0 {
+		res.Rate = opt.Rate
+	}
+	if opt.Resume > 0 {
+		res.Resume = opt.Resume
+	}
+	res.OnChunk = opt.OnChunk
+
+	return res
+}
+
+// 一块的处理结果，Start为第一个接收方的序号，Err不为nil时该块需要重试
+type BulkChunk struct {
+	Start      int64
+	Recipients []string
+	Added      int64 // 新写入的数量，已存在的消息只更新生命周期
+	Checkpoint int64 // 处理完该块后的Checkpoint
+	Err        error
+}
+
+// 批量写入的结果
+type BulkResult struct {
+	Total      int64        // 本次处理的接收方数量，不含跳过的
+	Added      int64        // 新写入的数量
+	Failed     []*BulkChunk // 失败的块
+	Checkpoint int64        // 已处理的接收方数量，含跳过的
+}
+
+// 批量写入用户消息，接收方为用户ID的十进制字符串，与NewUserMsg相同跳过0，ctx被取消时处理完当前块后返回
+func (this *Redis) BulkNewUserMsg(ctx context.Context, ttl int, msgid string, it BulkIterator, opt *BulkOption) (*BulkResult, error) {
+	return this.bulkEnqueue(ctx, "BulkNewUserMsg", targetUser, ttl, msgid, it, opt)
+}
+
+// 批量写入设备消息，接收方为devicekey，ctx被取消时处理完当前块后返回
+func (this *Redis) BulkNewDeviceMsg(ctx context.Context, ttl int, msgid string, it BulkIterator, opt *BulkOption) (*BulkResult, error) {
+	return this.bulkEnqueue(ctx, "BulkNewDeviceMsg", targetDevice, ttl, msgid, it, opt)
+}
+
+func (this *Redis) bulkEnqueue(ctx context.Context, op, kind string, ttl int, msgid string, it BulkIterator, opt *BulkOption) (*BulkResult, error) {
+	o := opt.fill()
+
+	res := &BulkResult{}
+	for res.Checkpoint < o.Resume {
+		if _, ok := it.Next(); !ok {
+			return res, nil
+		}
+		res.Checkpoint++
+	}
+
+	rc := this.pool.Get()
+	defer func() { rc.Close() }()
+
+	chunk := make([]string, 0, o.Chunk)
+	for ctx.Err() == nil {
+		chunk = chunk[:0]
+		for len(chunk) < o.Chunk {
+			to, ok := it.Next()
+			if !ok {
+				break
+			}
+			chunk = append(chunk, to)
+		}
+		if len(chunk) == 0 {
+			return res, nil
+		}
+
+		begin := time.Now()
+		c := &BulkChunk{Start: res.Checkpoint, Recipients: append([]string(nil), chunk...)}
+		c.Added, c.Err = this.enqueueChunk(rc, op, kind, ttl, msgid, c.Recipients)
+
+		res.Total += int64(len(chunk))
+		res.Checkpoint += int64(len(chunk))
+		res.Added += c.Added
+		c.Checkpoint = res.Checkpoint
+		if c.Err != nil {
+			res.Failed = append(res.Failed, c)
+		}
+		if o.OnChunk != nil {
+			o.OnChunk(c)
+		}
+
+		// 连接出错后换一个连接，后面的块不受影响
+		if rc.Err() != nil {
+			rc.Close()
+			rc = this.pool.Get()
+		}
+
+		if o.Rate > 0 {
+			wait := time.Second*time.Duration(len(chunk))/time.Duration(o.Rate) - time.Since(begin)
+			if wait > 0 && !sleepContext(ctx, wait) {
+				break
+			}
+		}
+	}
+
+	return res, ctx.Err()
+}
+
+// 用管道写入一块接收方，返回新写入的数量
+func (this *Redis) enqueueChunk(rc redis.Conn, op, kind string, ttl int, msgid string, recipients []string) (_ int64, err error) {
+	defer this.guard(op, &err)
+
+	keys := this.Keys()
+	end := time.Now().Add(time.Second * time.Duration(ttl))
+	score := this.score(end)
+	watch, _ := this.expiredLetters()
+
+	// 先构造所有参数，出错时管道中还没有未读的回复
+	zsets := make([]string, 0, len(recipients))
+	channels := make([]string, 0, len(recipients))
+	track := redis.Args{keys.Targets(msgid), ttl * 2}
+	index := redis.Args{keys.ExpiryIndex()}
+	for _, to := range recipients {
+		var zset, channel string
+		switch kind {
+		case targetUser:
+			userid, err := strconv.ParseInt(to, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("msgstore: invalid userid %q", to)
+			}
+			// 与NewUserMsg相同，userid为0时跳过
+			if userid == 0 {
+				continue
+			}
+			zset, channel = keys.User(userid), keys.UserChannel(userid)
+		default:
+			zset, channel = keys.Device(to), keys.DeviceChannel(to)
+		}
+		zsets, channels = append(zsets, zset), append(channels, channel)
+		track = track.Add(zset, kind)
+
+		if watch {
+			entry, err := json.Marshal(&expiryEntry{Kind: kind, To: to, MsgID: msgid, ZSet: zset})
+			if err != nil {
+				return 0, err
+			}
+			index = index.Add(encodeMillis(end), entry)
+		}
+	}
+
+	if len(zsets) == 0 {
+		return 0, nil
+	}
+
+	// 与doRegistered相同，登记在写入之后
+	for i := range zsets {
+		rc.Send("ZADD", zsets[i], score, msgid)
+		rc.Send("SADD", keys.Registry(), zsets[i])
+	}
+	if len(index) > 1 {
+		rc.Send("ZADD", index...)
+	}
+
+	replies, err := redis.Values(rc.Do(""))
+	if err != nil {
+		return 0, err
+	}
+
+	// 管道中的错误回复不会作为err返回，需要逐个检查
+	var added int64
+	var fresh []string
+	for i, r := range replies {
+		if e, ok := r.(redis.Error); ok {
+			return added, e
+		}
+		if i%2 == 0 && i/2 < len(zsets) {
+			if n, _ := redis.Int64(r, nil); n > 0 {
+				added += n
+				fresh = append(fresh, channels[i/2])
+			}
+		}
+	}
+
+	// 与notify相同，只通知新写入的接收方，消息已经存储，通知失败只回调ErrorHook
+	if len(fresh) > 0 {
+		for _, channel := range fresh {
+			rc.Send("PUBLISH", channel, msgid)
+		}
+		if err := replyErr(rc.Do("")); err != nil {
+			this.report("Notify", err)
+		}
+	}
+
+	if this.recallEnabled() {
+		if _, err := trackScript.Do(rc, track...); err != nil {
+			return added, err
+		}
+	}
+	this.autoRecordN(rc, msgid, EventStored, added)
+
+	return added, nil
+}
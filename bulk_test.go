@@ -0,0 +1,100 @@
+package MsgStore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestBulkNewUserMsg(t *testing.T) {
+	s, _ := newTestRedis(t)
+	ctx := context.Background()
+
+	var checkpoints []int64
+	opt := &BulkOption{Chunk: 2, OnChunk: func(c *BulkChunk) { checkpoints = append(checkpoints, c.Checkpoint) }}
+	res, err := s.BulkNewUserMsg(ctx, 60, "b-1", BulkUsers([]int64{6001, 0, 6002, 6003}), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 与NewUserMsg相同跳过0
+	if res.Total != 4 || res.Added != 3 || res.Checkpoint != 4 || len(res.Failed) != 0 {
+		t.Fatalf("BulkNewUserMsg = %+v", res)
+	}
+	if !reflect.DeepEqual(checkpoints, []int64{2, 4}) {
+		t.Errorf("checkpoints = %v", checkpoints)
+	}
+
+	for _, userid := range []int64{6001, 6002, 6003} {
+		ids, err := s.GetUserMsg(userid)
+		expectIDs(t, "GetUserMsg", ids, err, "b-1")
+	}
+
+	// 重试是幂等的，从Checkpoint继续时跳过已处理的接收方
+	res, err = s.BulkNewUserMsg(ctx, 60, "b-1", BulkUsers([]int64{6001, 0, 6002, 6003, 6004}), &BulkOption{Resume: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 3 || res.Added != 1 || res.Checkpoint != 5 {
+		t.Fatalf("BulkNewUserMsg resumed = %+v", res)
+	}
+
+	// 无效的用户ID只使所在的块失败
+	res, err = s.BulkNewUserMsg(ctx, 60, "b-2", BulkSlice([]string{"6005", "x", "6006"}), &BulkOption{Chunk: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Start != 0 || res.Added != 1 {
+		t.Fatalf("BulkNewUserMsg with invalid id = %+v", res)
+	}
+	ids, err := s.GetUserMsg(6006)
+	expectIDs(t, "GetUserMsg 6006", ids, err, "b-2")
+}
+
+func TestBulkNotifyOnlyNew(t *testing.T) {
+	s, mr := newTestRedis(t)
+
+	c, err := redis.Dial("tcp", mr.Addr(), redis.DialReadTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	psc := redis.PubSubConn{Conn: c}
+	defer psc.Close()
+
+	keys := s.Keys()
+	if err := psc.Subscribe(keys.DeviceChannel("dev-61"), keys.DeviceChannel("dev-62")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := psc.Receive().(redis.Subscription); !ok {
+			t.Fatal("subscription not confirmed")
+		}
+	}
+
+	// dev-61已有该消息，只通知dev-62
+	if _, err := s.NewDeviceMsg("dev-61", 60, "b-3"); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := psc.Receive().(redis.Message); !ok || m.Channel != keys.DeviceChannel("dev-61") {
+		t.Fatalf("notification of NewDeviceMsg = %v", m)
+	}
+
+	res, err := s.BulkNewDeviceMsg(context.Background(), 60, "b-3", BulkSlice([]string{"dev-61", "dev-62"}), nil)
+	if err != nil || res.Added != 1 {
+		t.Fatalf("BulkNewDeviceMsg = %+v, %v", res, err)
+	}
+
+	var got []string
+	for {
+		m, ok := psc.Receive().(redis.Message)
+		if !ok {
+			break
+		}
+		got = append(got, m.Channel+" "+string(m.Data))
+	}
+	if want := []string{keys.DeviceChannel("dev-62") + " b-3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("notifications = %v, want %v", got, want)
+	}
+}
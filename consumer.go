@@ -0,0 +1,157 @@
+package MsgStore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 广播队列的消费者，使用BLPOP阻塞读取，取代循环调用GetPublishMsg
+// 处理广播消息的回调，queue为消息所在的队列
+type PublishHandler func(queue string, msg []byte)
+
+// 消费者参数，零值字段使用默认值
+type ConsumeOption struct {
+	Concurrency  int           // 并发的消费协程数量，每个协程占用一个连接
+	BlockTimeout time.Duration // 单次BLPOP阻塞时长，也是响应ctx取消的最大延迟
+	MinBackoff   time.Duration // redis不可用时的初始重试间隔
+	MaxBackoff   time.Duration // redis不可用时的最大重试间隔
+}
+
+var defaultConsumeOption = ConsumeOption{
+	Concurrency:  1,
+	BlockTimeout: time.Second,
+	MinBackoff:   100 * time.Millisecond,
+	MaxBackoff:   10 * time.Second,
+}
+
+func (opt *ConsumeOption) fill() ConsumeOption {
+	res := defaultConsumeOption
+	if opt == nil {
+		return res
+	}
+
+	if opt.Concurrency > 0 {
+		res.Concurrency = opt.Concurrency
+	}
+	// BLPOP的超时以秒为单位，不足1秒按1秒算
+	if opt.BlockTimeout >= time.Second {
+		res.BlockTimeout = opt.BlockTimeout
+	}
+	if opt.MinBackoff > 0 {
+		res.MinBackoff = opt.MinBackoff
+	}
+	if opt.MaxBackoff >= res.MinBackoff {
+		res.MaxBackoff = opt.MaxBackoff
+	}
+
+	return res
+}
+
+// 阻塞消费一个或多个广播队列，直到ctx被取消才返回
+// 多个队列按参数顺序优先，handler可能被多个协程并发调用
+// STREAM队列不能用BLPOP消费，其中有STREAM队列时直接返回错误
+func (this *Redis) ConsumePublishMsg(ctx context.Context, queues []string, handler PublishHandler, opt *ConsumeOption) error {
+	if len(queues) == 0 || handler == nil {
+		return nil
+	}
+	for _, q := range queues {
+		if _, ok := this.streamQueue(q); ok {
+			return fmt.Errorf("queue %s is a stream, use ReadStreamMsg", q)
+		}
+	}
+
+	o := opt.fill()
+	var wg sync.WaitGroup
+	for i := 0; i < o.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			this.consumeLoop(ctx, queues, handler, o)
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+func (this *Redis) consumeLoop(ctx context.Context, queues []string, handler PublishHandler, o ConsumeOption) {
+	backoff := o.MinBackoff
+	for ctx.Err() == nil {
+		queue, msg, err := this.blockPop(queues, o.BlockTimeout)
+		if err != nil {
+			// redis不可用，按指数退避等待后重试
+			if !sleepContext(ctx, backoff) {
+				return
+			}
+			if backoff *= 2; backoff > o.MaxBackoff {
+				backoff = o.MaxBackoff
+			}
+			continue
+		}
+
+		backoff = o.MinBackoff
+		if msg != nil {
+			this.handlePublishMsg(handler, queue, msg)
+		}
+	}
+}
+
+// 阻塞弹出一个消息，超时返回空消息
+func (this *Redis) blockPop(queues []string, timeout time.Duration) (_ string, _ []byte, err error) {
+	defer this.guard("ConsumePublishMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	// 迁移期间每个队列的新key在前，旧key在后，BLPOP按参数顺序优先
+	names := make(map[string]string)
+	args := make([]interface{}, 0, len(queues)+1)
+	for _, k := range this.readKeys() {
+		for _, q := range queues {
+			if _, ok := this.streamQueue(q); ok {
+				continue
+			}
+
+			key := k.Queue(q)
+			if _, ok := names[key]; !ok {
+				names[key] = q
+				args = append(args, key)
+			}
+		}
+	}
+	args = append(args, int(timeout/time.Second))
+
+	// 返回ErrNil是因为阻塞超时，算不上错误
+	res, err := redis.ByteSlices(rc.Do("BLPOP", args...))
+	if err == redis.ErrNil {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return names[string(res[0])], res[1], nil
+}
+
+// 隔离回调中的panic，避免一个坏消息终止消费协程，panic通过ErrorHook报告
+func (this *Redis) handlePublishMsg(handler PublishHandler, queue string, msg []byte) {
+	var err error
+	defer this.guard("PublishHandler", &err)
+	handler(queue, msg)
+}
+
+// 等待d时长，ctx被取消时提前返回false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,105 @@
+package MsgStore
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// 计数器，计数器是HASH中的一个字段，不存在的字段值为0
+// 所有读改写都在服务端脚本中完成，并发调用不会丢失更新，计数也不会小于0
+
+// 增加计数，增加后超过max时不修改，max小于等于0时不限制
+// KEYS: hash
+// ARGV: 字段 增量 上限
+// 返回{是否增加, 当前值}
+var incrBoundedScript = redis.NewScript(1, `
+local cur = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+local max = tonumber(ARGV[3])
+local v = cur + tonumber(ARGV[2])
+if max > 0 and v > max then
+	return {0, cur}
+end
+return {1, redis.call('HINCRBY', KEYS[1], ARGV[1], ARGV[2])}
+`)
+
+// 依次从多个hash的同一字段中减去共计delta，每个字段最多减到0，减到0的字段被删除
+// 迁移期间新旧两个key的计数相加才是总数，先减新key再减旧key
+// KEYS: hash...
+// ARGV: 字段 减量
+// 返回减去后的总数
+var decrFloorScript = redis.NewScript(-1, `
+local left = tonumber(ARGV[2])
+local total = 0
+for i = 1, #KEYS do
+	local cur = tonumber(redis.call('HGET', KEYS[i], ARGV[1]) or '0')
+	local d = math.max(0, math.min(cur, left))
+	left = left - d
+	if cur - d <= 0 then
+		redis.call('HDEL', KEYS[i], ARGV[1])
+	else
+		if d > 0 then
+			redis.call('HINCRBY', KEYS[i], ARGV[1], -d)
+		end
+		total = total + cur - d
+	end
+end
+return total
+`)
+
+// 当前值等于expected时改为value，value为0时删除字段
+// KEYS: hash
+// ARGV: 字段 期望值 新值
+var compareAndResetScript = redis.NewScript(1, `
+local cur = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+if cur ~= tonumber(ARGV[2]) then
+	return 0
+end
+if tonumber(ARGV[3]) == 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+else
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+end
+return 1
+`)
+
+// 增加计数，超过max时不修改并返回false，返回增加后或未修改的当前值
+func (this *Redis) IncrCounter(key, field string, delta, max int64) (_ int64, _ bool, err error) {
+	defer this.guard("IncrCounter", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	res, err := redis.Values(incrBoundedScript.Do(rc, key, field, delta, max))
+	if err != nil {
+		return 0, false, err
+	}
+
+	var ok bool
+	var value int64
+	if _, err := redis.Scan(res, &ok, &value); err != nil {
+		return 0, false, err
+	}
+
+	return value, ok, nil
+}
+
+// 减少计数，最多减到0，减到0时删除字段，返回减少后的值
+func (this *Redis) DecrCounter(key, field string, delta int64) (_ int64, err error) {
+	defer this.guard("DecrCounter", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return decrFloor(rc, []string{key}, field, delta)
+}
+
+// 当前值等于expected时改为value，返回是否修改
+func (this *Redis) CompareAndResetCounter(key, field string, expected, value int64) (_ bool, err error) {
+	defer this.guard("CompareAndResetCounter", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return redis.Bool(compareAndResetScript.Do(rc, key, field, expected, value))
+}
+
+func decrFloor(rc redis.Conn, keys []string, field string, delta int64) (int64, error) {
+	args := redis.Args{len(keys)}.AddFlat(keys).Add(field, delta)
+	return redis.Int64(decrFloorScript.Do(rc, args...))
+}
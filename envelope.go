@@ -0,0 +1,145 @@
+package MsgStore
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 消息信封，使用HASH保存消息内容和元数据，key由KeyScheme.Envelope构造
+// 用户、设备、群组的有序集合中仍然只保存msgid
+const key_ENVELOPE = "Envelope-"
+
+type Envelope struct {
+	MsgID   string
+	Sender  string
+	Type    string
+	Body    []byte
+	Created time.Time
+}
+
+// 保存消息信封，ttl与消息的生命周期一致（秒），ttl不大于0时不过期
+func (this *Redis) SaveMsg(env *Envelope, ttl int) (err error) {
+	defer this.guard("SaveMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	created := env.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	key := this.Keys().Envelope(env.MsgID)
+	if err := rc.Send("MULTI"); err != nil {
+		return err
+	}
+	if err := rc.Send("DEL", key); err != nil {
+		return err
+	}
+	if err := rc.Send("HMSET", key, "sender", env.Sender, "type", env.Type, "body", env.Body,
+		"created", created.UnixNano()/int64(time.Millisecond)); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		if err := rc.Send("EXPIRE", key, ttl); err != nil {
+			return err
+		}
+	}
+
+	// EXEC的回复中包含每个命令的结果
+	return replyErr(rc.Do("EXEC"))
+}
+
+// 批量获取消息信封，已过期、已撤回或不存在的消息被跳过，返回的顺序与ids一致
+func (this *Redis) GetMsgs(ids ...string) (_ []*Envelope, err error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	defer this.guard("GetMsgs", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	// 迁移期间每个消息依次查询新旧两个key，取第一个存在的，任一方案中有撤回标记都跳过
+	schemes := this.readKeys()
+	for _, id := range ids {
+		for _, k := range schemes {
+			if err := rc.Send("HMGET", k.Envelope(id), "sender", "type", "body", "created"); err != nil {
+				return nil, err
+			}
+			if err := rc.Send("EXISTS", k.Recalled(id)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+
+	envs := make([]*Envelope, 0, len(ids))
+	for _, id := range ids {
+		var res []interface{}
+		recalled := false
+		for range schemes {
+			r, err := redis.Values(rc.Receive())
+			if err != nil {
+				return nil, err
+			}
+
+			// 字段全部为nil说明该key下信封不存在
+			if res == nil && (r[0] != nil || r[1] != nil || r[2] != nil || r[3] != nil) {
+				res = r
+			}
+
+			ok, err := redis.Bool(rc.Receive())
+			if err != nil {
+				return nil, err
+			}
+			recalled = recalled || ok
+		}
+		if res == nil || recalled {
+			continue
+		}
+
+		env := &Envelope{MsgID: id}
+		var created int64
+		if _, err := redis.Scan(res, &env.Sender, &env.Type, &env.Body, &created); err != nil {
+			return nil, err
+		}
+
+		env.Created = time.Unix(0, created*int64(time.Millisecond))
+		envs = append(envs, env)
+	}
+
+	return envs, nil
+}
+
+// 获取未过期的待发送用户消息的信封
+func (this *Redis) GetUserEnvelopes(userid int64) ([]*Envelope, error) {
+	ids, err := this.GetUserMsg(userid)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.GetMsgs(ids...)
+}
+
+// 获取未过期的待发送设备消息的信封
+func (this *Redis) GetDeviceEnvelopes(devicekey string) ([]*Envelope, error) {
+	ids, err := this.GetDeviceMsg(devicekey)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.GetMsgs(ids...)
+}
+
+// 获取用户需要发送的所有群组消息的信封
+func (this *Redis) GetGroupEnvelopes(key, userFlag string) ([]*Envelope, error) {
+	ids, err := this.GetGroupMsg(key, userFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.GetMsgs(ids...)
+}
@@ -0,0 +1,125 @@
+package MsgStore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 可以用errors.Is区分的错误
+var (
+	ErrQueueEmpty  = errors.New("msgstore: queue is empty")
+	ErrExpired     = errors.New("msgstore: message expired")
+	ErrUnavailable = errors.New("msgstore: storage unavailable")
+	ErrNotMember   = errors.New("msgstore: not a group member")
+
+	ErrRecallDisabled = errors.New("msgstore: recall is not enabled")
+)
+
+// 存储操作的错误，Op为出错的方法，Kind为哨兵错误（可能为nil），Err为底层错误
+type StoreError struct {
+	Op   string
+	Kind error
+	Err  error
+}
+
+func (e *StoreError) Error() string {
+	if e.Kind != nil {
+		return fmt.Sprintf("msgstore: %s: %v: %v", e.Op, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("msgstore: %s: %v", e.Op, e.Err)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StoreError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// 存储出错时的回调，op为出错的方法，ErrQueueEmpty、ErrExpired和ErrNotMember不算出错
+type ErrorHook func(op string, err error)
+
+// 设置存储出错时的回调，用于告警，nil表示不回调
+func (this *Redis) OnError(hook ErrorHook) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.hook = hook
+}
+
+// 在方法入口defer调用，把panic转为错误，给错误分类并回调ErrorHook
+// 内层方法返回的*StoreError已经回调过，原样返回，同一个错误只回调一次
+func (this *Redis) guard(op string, err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("panic: %v", r)
+	}
+
+	*err = this.report(op, *err)
+}
+
+// 给错误分类并回调ErrorHook，返回分类后的错误
+// 也用于不返回给调用方的错误，如消息已经存储后的通知失败
+func (this *Redis) report(op string, err error) error {
+	if err == nil || errors.Is(err, ErrQueueEmpty) || errors.Is(err, ErrExpired) || errors.Is(err, ErrNotMember) {
+		return err
+	}
+
+	if _, ok := err.(*StoreError); ok {
+		return err
+	}
+	err = &StoreError{Op: op, Kind: classify(err), Err: err}
+
+	this.mu.RLock()
+	hook := this.hook
+	this.mu.RUnlock()
+
+	if hook != nil {
+		hook(op, err)
+	}
+
+	return err
+}
+
+// 管道和事务的回复中，单个命令的错误回复不会作为err返回，需要逐个检查
+func replyErr(reply interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+
+	values, _ := reply.([]interface{})
+	for _, v := range values {
+		if e, ok := v.(redis.Error); ok {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// 连接失败、网络中断、连接池耗尽归为ErrUnavailable，redis返回的错误回复和数据格式错误不归类
+func classify(err error) error {
+	if _, ok := err.(redis.Error); ok {
+		return nil
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrUnavailable
+	}
+
+	// redigo连接池和连接状态的错误没有导出
+	msg := err.Error()
+	if strings.HasPrefix(msg, "redigo: connection pool") ||
+		strings.HasPrefix(msg, "redigo: get on closed pool") ||
+		strings.HasPrefix(msg, "redigo: closed") {
+		return ErrUnavailable
+	}
+
+	return nil
+}
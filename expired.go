@@ -0,0 +1,516 @@
+package MsgStore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 过期未送达消息的死信
+// EnableExpiredLetters后，用户、设备、群组消息写入时在过期索引中登记生命终点（Unix毫秒数）
+// CollectExpired按索引找出到期时仍在待发送集合中的消息，写入按类型划分的死信集合，并在HASH中保存死信内容
+// 待发送集合中的消息不删除，仍由ClearOutDateMsg和后台清理按原来的规则删除，GetPushedUserMsg的已超时结果不受影响
+// 启用后ClearOutDateMsg和后台清理在删除之前先收集死信
+
+const key_EXPIRY = "MsgStore-Expiry"
+const key_EXPIRED = "MsgStore-Expired-"
+
+// 死信的原因
+const (
+	ExpiredUnread  = "unread"  // 生存期内没有被取走
+	ExpiredPartial = "partial" // 群组消息过期时只有部分成员收到过
+)
+
+// 每次收集处理的索引条目数量
+const expired_BATCH = 500
+
+// 索引中的消息已被重新写入、生命终点延后时，间隔多久再检查（毫秒）
+const expired_RECHECK = 60 * 1000
+
+// 消息生命终点的索引
+func (k KeyScheme) ExpiryIndex() string {
+	if k.legacy() {
+		return key_EXPIRY
+	}
+	return k.Prefix + ":expiry"
+}
+
+// 一种类型的死信集合，score为消息的生命终点毫秒数
+func (k KeyScheme) ExpiredLetters(kind string) string {
+	if k.legacy() {
+		return key_EXPIRED + kind
+	}
+	return k.join("expired", kind)
+}
+
+// 死信内容的HASH
+func (k KeyScheme) ExpiredLetterData() string {
+	if k.legacy() {
+		return key_EXPIRED + "Data"
+	}
+	return k.Prefix + ":expired:data"
+}
+
+// 处理一批到期的索引条目，返回{处理的条目数, 写入的死信数, 写入死信的用户和设备消息ID}
+// 条目由调用方事先读出，每个条目用到的key都在KEYS中声明；条目已被其他进程处理或延后时跳过
+// 待发送集合已不是有序集合时按已送达处理
+// 群组消息按成员集合统计收到过的成员，所有成员都收到过时不算死信，部分收到为partial，都没有收到为unread
+// 没有成员集合的群组无法知道谁没有收到，有人收到过即按已送达处理，标记集合中的"0"是创建时的占位
+// 死信ID为类型:接收方:msgid，同一消息对同一接收方只有一条死信
+// KEYS: 过期索引 死信内容 用户死信 设备死信 群组死信 每个条目的待发送集合[ 群组标记集合... 成员集合...]...
+// ARGV: 当前毫秒 批量 保留毫秒 重新检查的间隔 区间数量 min max... 方案数量 每个条目的{条目 第一个key的下标}...
+// 群组条目的标记集合和成员集合各有方案数量个，其他条目只有待发送集合
+var collectExpiredScript = redis.NewScript(-1, `
+local now, batch, retention, recheck = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local nr = tonumber(ARGV[5])
+local letters = {user = KEYS[3], device = KEYS[4], group = KEYS[5]}
+
+local function within(s, b, lower)
+	if b == '-inf' then
+		return lower
+	end
+	if b == '+inf' then
+		return not lower
+	end
+	local open = string.sub(b, 1, 1) == '('
+	if open then
+		b = string.sub(b, 2)
+	end
+	local v = tonumber(b)
+	if lower then
+		return s > v or (not open and s == v)
+	end
+	return s < v or (not open and s == v)
+end
+
+local function expired(s)
+	for j = 1, nr do
+		if within(s, ARGV[4 + 2 * j], true) and within(s, ARGV[5 + 2 * j], false) then
+			return true
+		end
+	end
+	return false
+end
+
+local ns = tonumber(ARGV[6 + 2 * nr])
+
+-- 返回{收到过的成员数, 成员总数}，成员总数为0表示没有成员集合
+-- first为标记集合的第一个key的下标，成员集合紧随其后
+local function coverage(first)
+	local members = {}
+	for j = 1, ns do
+		members[#members + 1] = KEYS[first + ns + j - 1]
+	end
+	local total
+	if #members == 1 then
+		total = redis.call('SCARD', members[1])
+	else
+		total = #redis.call('SUNION', unpack(members))
+	end
+	local delivered, seen = 0, {}
+	for j = 1, ns do
+		for _, m in ipairs(redis.call('SMEMBERS', KEYS[first + j - 1])) do
+			if m ~= '0' and not seen[m] then
+				seen[m] = true
+				if total == 0 then
+					delivered = delivered + 1
+				else
+					for _, key in ipairs(members) do
+						if redis.call('SISMEMBER', key, m) == 1 then
+							delivered = delivered + 1
+							break
+						end
+					end
+				end
+			end
+		end
+	end
+	return delivered, total
+end
+
+local count, processed, moved = 0, 0, {}
+for i = 7 + 2 * nr, #ARGV, 2 do
+	local entry, first = ARGV[i], tonumber(ARGV[i + 1])
+	local at = redis.call('ZSCORE', KEYS[1], entry)
+	if at and tonumber(at) <= now then
+		processed = processed + 1
+		local e = cjson.decode(entry)
+		redis.call('ZREM', KEYS[1], entry)
+		local s = redis.pcall('ZSCORE', KEYS[first], e.msgid)
+		if type(s) == 'table' then
+			s = nil
+		end
+		if s and not expired(tonumber(s)) then
+			redis.call('ZADD', KEYS[1], now + recheck, entry)
+		elseif s and letters[e.kind] then
+			local reason, delivered, skip = 'unread', 0, false
+			if e.kind == 'group' then
+				local total
+				delivered, total = coverage(first + 1)
+				if total == 0 then
+					skip = delivered > 0
+				elseif delivered >= total then
+					skip = true
+				elseif delivered > 0 then
+					reason = 'partial'
+				end
+			else
+				moved[#moved + 1] = e.msgid
+			end
+			if not skip then
+				local id = e.kind .. ':' .. e.to .. ':' .. e.msgid
+				redis.call('HSET', KEYS[2], id, cjson.encode({kind = e.kind, to = e.to, msgid = e.msgid,
+					reason = reason, delivered = delivered, expired = tonumber(at), collected = now}))
+				redis.call('ZADD', letters[e.kind], at, id)
+				count = count + 1
+			end
+		end
+	end
+end
+
+if retention > 0 then
+	for _, key in pairs(letters) do
+		local old = redis.call('ZRANGEBYSCORE', key, '-inf', now - retention, 'LIMIT', 0, batch)
+		for _, id in ipairs(old) do
+			redis.call('HDEL', KEYS[2], id)
+			redis.call('ZREM', key, id)
+		end
+	end
+end
+
+return {processed, count, moved}
+`)
+
+// 过期索引的条目，成员为JSON，同一消息重复写入同一集合时覆盖原条目
+type expiryEntry struct {
+	Kind  string `json:"kind"`
+	To    string `json:"to"`
+	MsgID string `json:"msgid"`
+	ZSet  string `json:"zset"`
+}
+
+// 一条死信，Kind为user、device或group，To为用户ID、设备key或群组key
+// Delivered为群组消息过期时收到过的成员数量，Expired为消息的生命终点，Collected为收集的时间
+type ExpiredLetter struct {
+	ID        string
+	Kind      string
+	To        string
+	MsgID     string
+	Reason    string
+	Delivered int64
+	Expired   time.Time
+	Collected time.Time
+}
+
+// 保存在redis中的死信内容，由脚本写入，时间为毫秒数
+type expiredLetterStored struct {
+	Kind      string `json:"kind"`
+	To        string `json:"to"`
+	MsgID     string `json:"msgid"`
+	Reason    string `json:"reason"`
+	Delivered int64  `json:"delivered"`
+	Expired   int64  `json:"expired"`
+	Collected int64  `json:"collected"`
+}
+
+// 死信查询条件，时间为消息的生命终点，Start、End为零值时不限制，结果按时间从新到旧排列
+type ExpiredQuery struct {
+	Start  time.Time
+	End    time.Time
+	Offset int
+	Limit  int // 小于等于0时返回全部
+}
+
+// 开始登记和收集死信，retention为死信的保留时长，0表示不淘汰
+// 只有启用之后写入的消息会被收集
+func (this *Redis) EnableExpiredLetters(retention time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.expired = true
+	this.expiredRetention = retention
+}
+
+func (this *Redis) expiredLetters() (bool, time.Duration) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.expired, this.expiredRetention
+}
+
+// 在过期索引中登记消息的生命终点，未启用死信时不登记
+func (this *Redis) watchExpiry(rc redis.Conn, kind, to, msgid, zset string, end time.Time) error {
+	if ok, _ := this.expiredLetters(); !ok {
+		return nil
+	}
+
+	entry, err := json.Marshal(&expiryEntry{Kind: kind, To: to, MsgID: msgid, ZSet: zset})
+	if err != nil {
+		return err
+	}
+
+	_, err = rc.Do("ZADD", this.Keys().ExpiryIndex(), encodeMillis(end), entry)
+	return err
+}
+
+// 收集所有已到期的死信，返回新写入的死信数量，未启用死信时不做任何操作
+// 多个进程同时收集是安全的，每批在服务端原子完成
+func (this *Redis) CollectExpired() (_ int64, err error) {
+	if ok, _ := this.expiredLetters(); !ok {
+		return 0, nil
+	}
+
+	defer this.guard("CollectExpired", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return this.collectExpired(rc)
+}
+
+func (this *Redis) collectExpired(rc redis.Conn) (int64, error) {
+	_, retention := this.expiredLetters()
+	keys := this.Keys()
+	schemes := this.readKeys()
+
+	var count int64
+	for _, k := range schemes {
+		for {
+			now := time.Now()
+			entries, err := redis.Strings(rc.Do("ZRANGEBYSCORE", k.ExpiryIndex(), "-inf", encodeMillis(now), "LIMIT", 0, expired_BATCH))
+			if err != nil {
+				return count, err
+			}
+
+			zsets := redis.Args{k.ExpiryIndex(), keys.ExpiredLetterData(),
+				keys.ExpiredLetters(targetUser), keys.ExpiredLetters(targetDevice), keys.ExpiredLetters(targetGroup)}
+			args := redis.Args{encodeMillis(now), expired_BATCH, int64(retention / time.Millisecond), expired_RECHECK}
+			args = append(args, this.rangeArgs(time.Time{}, now)...)
+			args = args.Add(len(schemes))
+			for _, entry := range entries {
+				var e expiryEntry
+				if err := json.Unmarshal([]byte(entry), &e); err != nil {
+					// 无法解析的条目永远不会被处理，直接从索引中删除
+					if _, err := rc.Do("ZREM", k.ExpiryIndex(), entry); err != nil {
+						return count, err
+					}
+					continue
+				}
+
+				// 脚本中KEYS的下标从1开始
+				args = args.Add(entry, len(zsets)+1)
+				zsets = zsets.Add(e.ZSet)
+				if e.Kind == targetGroup {
+					for _, s := range schemes {
+						zsets = zsets.Add(s.GroupMark(e.MsgID))
+					}
+					for _, s := range schemes {
+						zsets = zsets.Add(s.Members(e.To))
+					}
+				}
+			}
+
+			res, err := redis.Values(collectExpiredScript.Do(rc, append(redis.Args{len(zsets)}.AddFlat(zsets), args...)...))
+			if err != nil {
+				return count, err
+			}
+
+			var n int
+			var c int64
+			var moved []string
+			if _, err := redis.Scan(res, &n, &c, &moved); err != nil {
+				return count, err
+			}
+
+			count += c
+			for _, msgid := range moved {
+				this.autoRecord(rc, msgid, EventExpired)
+			}
+
+			if len(entries) < expired_BATCH {
+				break
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// 分页查询一种类型的死信，kind为user、device或group
+func (this *Redis) GetExpiredLetters(kind string, q ExpiredQuery) (_ []*ExpiredLetter, err error) {
+	defer this.guard("GetExpiredLetters", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	// 每个方案最多取Offset+Limit个，合并排序后再分页
+	count := -1
+	if q.Limit > 0 {
+		count = q.Offset + q.Limit
+	}
+
+	var letters []*ExpiredLetter
+	seen := make(map[string]bool)
+	for _, k := range this.readKeys() {
+		ids, err := redis.Strings(rc.Do("ZREVRANGEBYSCORE", k.ExpiredLetters(kind),
+			bound(q.End, encodeMillis, "+inf"), bound(q.Start, encodeMillis, "-inf"), "LIMIT", 0, count))
+		if err != nil {
+			return nil, err
+		}
+
+		var fresh []string
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				fresh = append(fresh, id)
+			}
+		}
+
+		res, err := this.loadExpiredLetters(rc, k, fresh)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, res...)
+	}
+
+	return pageExpiredLetters(letters, q), nil
+}
+
+func (this *Redis) loadExpiredLetters(rc redis.Conn, k KeyScheme, ids []string) ([]*ExpiredLetter, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	res, err := redis.Values(rc.Do("HMGET", redis.Args{k.ExpiredLetterData()}.AddFlat(ids)...))
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]*ExpiredLetter, 0, len(ids))
+	for i, v := range res {
+		// 内容已被淘汰的跳过
+		if v == nil {
+			continue
+		}
+
+		data, err := redis.Bytes(v, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var stored expiredLetterStored
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("msgstore: expired letter %s: %v", ids[i], err)
+		}
+
+		letters = append(letters, &ExpiredLetter{
+			ID:        ids[i],
+			Kind:      stored.Kind,
+			To:        stored.To,
+			MsgID:     stored.MsgID,
+			Reason:    stored.Reason,
+			Delivered: stored.Delivered,
+			Expired:   time.Unix(0, stored.Expired*int64(time.Millisecond)),
+			Collected: time.Unix(0, stored.Collected*int64(time.Millisecond)),
+		})
+	}
+
+	return letters, nil
+}
+
+// 按生命终点从新到旧排序后分页
+func pageExpiredLetters(letters []*ExpiredLetter, q ExpiredQuery) []*ExpiredLetter {
+	sort.SliceStable(letters, func(i, j int) bool {
+		return letters[i].Expired.After(letters[j].Expired)
+	})
+
+	if q.Offset >= len(letters) {
+		return nil
+	}
+	if q.Offset > 0 {
+		letters = letters[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit < len(letters) {
+		letters = letters[:q.Limit]
+	}
+
+	return letters
+}
+
+// 统计一种类型在时间区间内的死信数量
+func (this *Redis) CountExpiredLetters(kind string, start, end time.Time) (_ int64, err error) {
+	defer this.guard("CountExpiredLetters", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	var count int64
+	for _, k := range this.readKeys() {
+		n, err := redis.Int64(rc.Do("ZCOUNT", k.ExpiredLetters(kind),
+			bound(start, encodeMillis, "-inf"), bound(end, encodeMillis, "+inf")))
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+
+	return count, nil
+}
+
+// 重新发送死信，以ttl为新的生存秒数写回原来的用户、设备或群组，成功后删除死信
+// 已撤回的消息不再发送，只删除死信，不计入返回的数量
+// 返回重新发送的数量，出错时停止，之前的死信已重新发送并删除
+func (this *Redis) RedriveExpired(ttl int, letters ...*ExpiredLetter) (int64, error) {
+	var count int64
+	for _, l := range letters {
+		recalled, err := this.IsRecalled(l.MsgID)
+		if err != nil {
+			return count, err
+		}
+		if recalled {
+			if err := this.DeleteExpiredLetter(l); err != nil {
+				return count, err
+			}
+			continue
+		}
+
+		switch l.Kind {
+		case targetUser:
+			var userid int64
+			if userid, err = strconv.ParseInt(l.To, 10, 64); err == nil {
+				_, err = this.NewUserMsg(userid, ttl, l.MsgID)
+			}
+		case targetDevice:
+			_, err = this.NewDeviceMsg(l.To, ttl, l.MsgID)
+		case targetGroup:
+			_, err = this.NewGroupMsg(l.To, l.MsgID, ttl)
+		default:
+			err = fmt.Errorf("msgstore: unknown expired letter kind %q", l.Kind)
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if err := this.DeleteExpiredLetter(l); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// 删除一条死信，用于已处理或不需要重新发送的死信
+func (this *Redis) DeleteExpiredLetter(l *ExpiredLetter) (err error) {
+	defer this.guard("DeleteExpiredLetter", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	for _, k := range this.readKeys() {
+		rc.Send("ZREM", k.ExpiredLetters(l.Kind), l.ID)
+		rc.Send("HDEL", k.ExpiredLetterData(), l.ID)
+	}
+
+	return replyErr(rc.Do(""))
+}
@@ -0,0 +1,87 @@
+package MsgStore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollectExpired(t *testing.T) {
+	s, _ := newTestRedis(t)
+	s.EnableExpiredLetters(0)
+
+	if _, err := s.NewUserMsg(4001, 1, "e-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewDeviceMsg("dev-41", 1, "e-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MarkDeviceMsg("dev-41", "e-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.JoinGroup("grp-41", "amy", "ben"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewGroupMsg("grp-41", "e-3", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MarkGroupMsg(false, 0, "amy", "e-3"); err != nil {
+		t.Fatal(err)
+	}
+	// 重新写入后生命终点延后，到期时不算死信
+	if _, err := s.NewUserMsg(4002, 1, "e-4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewUserMsg(4002, 60, "e-4"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	n, err := s.CollectExpired()
+	if err != nil || n != 2 {
+		t.Fatalf("CollectExpired = %d, %v, want 2", n, err)
+	}
+	if n, err = s.CollectExpired(); err != nil || n != 0 {
+		t.Fatalf("CollectExpired again = %d, %v, want 0", n, err)
+	}
+
+	letters, err := s.GetExpiredLetters(targetUser, ExpiredQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].To != "4001" || letters[0].Reason != ExpiredUnread {
+		t.Fatalf("user letters = %+v", letters)
+	}
+
+	if c, err := s.CountExpiredLetters(targetDevice, time.Time{}, time.Time{}); err != nil || c != 0 {
+		t.Errorf("device letters = %d, %v, want 0", c, err)
+	}
+
+	letters, err = s.GetExpiredLetters(targetGroup, ExpiredQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Reason != ExpiredPartial || letters[0].Delivered != 1 {
+		t.Fatalf("group letters = %+v", letters)
+	}
+}
+
+func TestClearOutDateMsgCollectsFirst(t *testing.T) {
+	s, _ := newTestRedis(t)
+	s.EnableExpiredLetters(0)
+
+	if _, err := s.NewUserMsg(4003, 1, "e-5"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	n, err := s.ClearOutDateMsg(0)
+	if err != nil || n != 1 {
+		t.Fatalf("ClearOutDateMsg = %d, %v, want 1", n, err)
+	}
+
+	c, err := s.CountExpiredLetters(targetUser, time.Time{}, time.Time{})
+	if err != nil || c != 1 {
+		t.Errorf("user letters = %d, %v, want 1", c, err)
+	}
+}
@@ -0,0 +1,271 @@
+package MsgStore
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 用户的多设备
+// 用户绑定的设备保存在ZSET中，score为设备最近在线的Unix毫秒数，与ScoreCodec无关
+// SendToUser把消息ID一次写入用户所有活跃设备的设备消息集合，并用HASH记录每个设备的送达时间
+// HASH的字段为设备key，值为送达的Unix毫秒数，0表示尚未送达
+
+const key_DEVICES = "Devices-"
+const key_FANOUT = "Fanout-"
+
+// 用户绑定的设备
+func (k KeyScheme) UserDevices(userid int64) string {
+	if k.legacy() {
+		return key_DEVICES + userKey(userid)
+	}
+	return k.join("user", userid) + ":devices"
+}
+
+// 多设备消息在一个用户的设备上的送达状态，同一个msgid发给多个用户时各自记录
+func (k KeyScheme) Fanout(userid int64, msgid string) string {
+	if k.legacy() {
+		return key_FANOUT + userKey(userid) + "-" + msgid
+	}
+	return k.join("user", userid) + ":fanout:" + msgid
+}
+
+// 设备通知频道的前缀，DeviceChannel(devicekey)为前缀加devicekey
+func (k KeyScheme) deviceChannelPrefix() string {
+	if k.legacy() {
+		return key_NOTIFY + NotifyDevice + "-"
+	}
+	return k.Prefix + ":notify:device:"
+}
+
+// 写入活跃设备的设备消息集合，登记、记录投递并通知，返回写入的设备
+// 设备由调用方事先读出，设备消息集合在KEYS中声明；脚本内重新检查设备仍然绑定且活跃，期间解绑的设备跳过
+// ARGV[6]为1时在投递记录中登记设备消息集合，供撤回使用
+// KEYS: 用户设备 送达状态 登记集合 投递记录 设备消息集合...
+// ARGV: 最早在线毫秒数 消息score msgid 生存秒数 通知频道前缀 是否登记投递记录 设备key...（与设备消息集合一一对应）
+var sendToUserScript = redis.NewScript(-1, `
+local track = ARGV[6] == '1'
+local devices = {}
+for i = 5, #KEYS do
+	local d = ARGV[i + 2]
+	local seen = redis.call('ZSCORE', KEYS[1], d)
+	if seen and (ARGV[1] == '-inf' or tonumber(seen) >= tonumber(ARGV[1])) then
+		redis.call('ZADD', KEYS[i], ARGV[2], ARGV[3])
+		redis.call('SADD', KEYS[3], KEYS[i])
+		if track then
+			redis.call('HSET', KEYS[4], KEYS[i], 'device')
+		end
+		redis.call('HSETNX', KEYS[2], d, 0)
+		redis.call('PUBLISH', ARGV[5] .. d, ARGV[3])
+		devices[#devices + 1] = d
+	end
+end
+if #devices > 0 then
+	redis.call('EXPIRE', KEYS[2], ARGV[4])
+	if track and redis.call('TTL', KEYS[4]) < tonumber(ARGV[4]) then
+		redis.call('EXPIRE', KEYS[4], ARGV[4])
+	end
+end
+return devices
+`)
+
+// 记录设备的送达时间，只记录SendToUser发送过的设备，已送达的不覆盖
+// KEYS: 送达状态
+// ARGV: 设备key 当前毫秒数
+var markFanoutScript = redis.NewScript(1, `
+if redis.call('HGET', KEYS[1], ARGV[1]) == '0' then
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// 用户绑定的一个设备
+type UserDevice struct {
+	DeviceKey string
+	LastSeen  time.Time
+}
+
+// 多设备消息的送达状态，Delivered中为设备key到送达时间
+type FanoutState struct {
+	Pending   []string
+	Delivered map[string]time.Time
+}
+
+// 是否已送达任一设备
+func (s *FanoutState) Any() bool {
+	return len(s.Delivered) > 0
+}
+
+// 绑定设备到用户，同时更新最近在线时间，返回新绑定的数量0|1
+func (this *Redis) BindDevice(userid int64, devicekey string) (_ int64, err error) {
+	defer this.guard("BindDevice", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return redis.Int64(rc.Do("ZADD", this.Keys().UserDevices(userid), nowMillis(), devicekey))
+}
+
+// 解除绑定，返回解除的数量0|1
+func (this *Redis) UnbindDevice(userid int64, devicekey string) (_ int64, err error) {
+	defer this.guard("UnbindDevice", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.UserDevices(userid) })
+	return removeFromAll(rc, keys, devicekey)
+}
+
+// 更新已绑定设备的最近在线时间，返回设备是否已绑定
+func (this *Redis) TouchDevice(userid int64, devicekey string) (_ bool, err error) {
+	defer this.guard("TouchDevice", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	// XX只更新已存在的成员，CH使返回值为被修改的数量
+	n, err := redis.Int64(rc.Do("ZADD", this.Keys().UserDevices(userid), "XX", "CH", nowMillis(), devicekey))
+	return n > 0, err
+}
+
+// 获取用户绑定的设备，activeWithin大于0时只返回该时长内在线过的设备
+func (this *Redis) GetUserDevices(userid int64, activeWithin time.Duration) (_ []*UserDevice, err error) {
+	defer this.guard("GetUserDevices", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	min := activeSince(activeWithin)
+	var devices []*UserDevice
+	seen := make(map[string]bool)
+	for _, k := range this.readKeys() {
+		res, err := redis.Strings(rc.Do("ZRANGEBYSCORE", k.UserDevices(userid), min, "+inf", "WITHSCORES"))
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i+1 < len(res); i += 2 {
+			if seen[res[i]] {
+				continue
+			}
+			seen[res[i]] = true
+
+			ms, err := strconv.ParseFloat(res[i+1], 64)
+			if err != nil {
+				return nil, err
+			}
+			devices = append(devices, &UserDevice{DeviceKey: res[i], LastSeen: DecodeScore(ms)})
+		}
+	}
+
+	return devices, nil
+}
+
+func activeSince(activeWithin time.Duration) interface{} {
+	if activeWithin <= 0 {
+		return "-inf"
+	}
+	return nowMillis() - int64(activeWithin/time.Millisecond)
+}
+
+// 把用户消息发送到用户所有活跃的设备，activeWithin含义同GetUserDevices
+// 消息ID只写入设备消息集合，返回写入的设备，没有活跃设备时返回空
+func (this *Redis) SendToUser(userid int64, ttl int, msgid string, activeWithin time.Duration) (_ []string, err error) {
+	defer this.guard("SendToUser", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	keys := this.Keys()
+	end := time.Now().Add(time.Second * time.Duration(ttl))
+	track := 0
+	if this.recallEnabled() {
+		track = 1
+	}
+	min := activeSince(activeWithin)
+	active, err := redis.Strings(rc.Do("ZRANGEBYSCORE", keys.UserDevices(userid), min, "+inf"))
+	if err != nil || len(active) == 0 {
+		return nil, err
+	}
+
+	targets := []string{keys.UserDevices(userid), keys.Fanout(userid, msgid), keys.Registry(), keys.Targets(msgid)}
+	for _, d := range active {
+		targets = append(targets, keys.Device(d))
+	}
+	args := redis.Args{len(targets)}.AddFlat(targets).
+		Add(min, this.score(end), msgid, ttl*2, keys.deviceChannelPrefix(), track).AddFlat(active)
+
+	devices, err := redis.Strings(sendToUserScript.Do(rc, args...))
+	if err != nil || len(devices) == 0 {
+		return devices, err
+	}
+	this.autoRecord(rc, msgid, EventStored)
+
+	for _, d := range devices {
+		if err := this.watchExpiry(rc, targetDevice, d, msgid, keys.Device(d), end); err != nil {
+			return devices, err
+		}
+	}
+
+	return devices, nil
+}
+
+// 标记设备收到了SendToUser发送给用户的消息，返回标记过的消息数量0|1
+func (this *Redis) MarkUserDeviceMsg(userid int64, devicekey, msgid string) (_ int64, err error) {
+	n, err := this.MarkDeviceMsg(devicekey, msgid)
+	if err != nil {
+		return n, err
+	}
+
+	defer this.guard("MarkUserDeviceMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	for _, k := range this.readKeys() {
+		c, err := redis.Int64(markFanoutScript.Do(rc, k.Fanout(userid, msgid), devicekey, nowMillis()))
+		if err != nil || c > 0 {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// 获取SendToUser发送给用户的消息在各设备的送达状态
+func (this *Redis) GetFanoutState(userid int64, msgid string) (_ *FanoutState, err error) {
+	defer this.guard("GetFanoutState", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	state := &FanoutState{Delivered: make(map[string]time.Time)}
+	seen := make(map[string]bool)
+	for _, k := range this.readKeys() {
+		res, err := redis.Int64Map(rc.Do("HGETALL", k.Fanout(userid, msgid)))
+		if err != nil {
+			return nil, err
+		}
+
+		for device, ms := range res {
+			if seen[device] {
+				continue
+			}
+			seen[device] = true
+
+			if ms > 0 {
+				state.Delivered[device] = time.Unix(0, ms*int64(time.Millisecond))
+			} else {
+				state.Pending = append(state.Pending, device)
+			}
+		}
+	}
+
+	return state, nil
+}
+
+// 是否已送达用户的任一设备
+func (this *Redis) IsDeliveredToAny(userid int64, msgid string) (bool, error) {
+	state, err := this.GetFanoutState(userid, msgid)
+	if err != nil {
+		return false, err
+	}
+
+	return state.Any(), nil
+}
@@ -0,0 +1,336 @@
+package MsgStore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 按消息类别的频率限制，取代FullOfficialDevice中写死的每天1条、7天3条
+// 策略保存在redis的HASH中，字段为类别，值为JSON，修改后立即对所有进程生效，不需要改代码和重启
+// 每个对象（设备、用户）每个类别用一个ZSET记录发送时间，所有规则在服务端脚本中一次判断和记录
+
+const key_CAP = "Cap-"
+const key_CAP_POLICY = "MsgStore-CapPolicy"
+
+// 一条限制规则：任意Window时长的滑动窗口内最多Max条
+type CapRule struct {
+	Window time.Duration
+	Max    int64
+}
+
+// 配置文件中的规则，Window为time.ParseDuration的格式，如{"window":"24h","max":1}
+type capRuleConfig struct {
+	Window string `json:"window"`
+	Max    int64  `json:"max"`
+}
+
+// 保存在redis中的规则，Window为毫秒，供脚本使用
+type capRuleStored struct {
+	Window int64 `json:"window"`
+	Max    int64 `json:"max"`
+}
+
+// 官方消息的类别，MarkOfficialDevice、FullOfficialDevice按该类别的策略限制
+const CapOfficial = "official"
+
+// 官方消息原有的限制：每天1条，7天3条，没有在redis中配置official策略时使用
+var OfficialCapRules = []CapRule{
+	{Window: 24 * time.Hour, Max: 1},
+	{Window: 7 * 24 * time.Hour, Max: 3},
+}
+
+// 没有配置策略时各类别的默认规则
+var defaultCapPolicies = map[string][]CapRule{
+	CapOfficial: OfficialCapRules,
+}
+
+// 频率限制策略的HASH
+func (k KeyScheme) CapPolicy() string {
+	if k.legacy() {
+		return key_CAP_POLICY
+	}
+	return k.Prefix + ":cappolicy"
+}
+
+// 对象在某个类别下的发送记录
+func (k KeyScheme) Cap(category, subject string) string {
+	if k.legacy() {
+		return key_CAP + category + "-" + subject
+	}
+	return k.join("cap:"+category, subject)
+}
+
+// 按策略判断能否再发送一条，可以发送且ARGV[3]为1时记录本次发送，记录的成员为ARGV[4]
+// 没有配置策略时使用ARGV[5]中的默认规则，默认规则也为空的类别不限制也不记录
+// KEYS: 策略HASH 发送记录
+// ARGV: 类别 当前毫秒 是否记录 成员 默认规则
+// 返回{是否允许, 下次允许的毫秒数}，永远不允许时为-1
+var capScript = redis.NewScript(2, `
+local raw = redis.call('HGET', KEYS[1], ARGV[1])
+local now = tonumber(ARGV[2])
+if not raw then
+	raw = ARGV[5]
+end
+if raw == '' then
+	return {1, now}
+end
+local allow, longest = now, 0
+for _, r in ipairs(cjson.decode(raw)) do
+	if r.max <= 0 then
+		return {0, -1}
+	end
+	local min = '(' .. (now - r.window)
+	local cnt = redis.call('ZCOUNT', KEYS[2], min, '+inf')
+	if cnt >= r.max then
+		-- 窗口内第cnt-max+1早的记录滑出窗口后才能再发送
+		local t = redis.call('ZRANGEBYSCORE', KEYS[2], min, '+inf', 'WITHSCORES', 'LIMIT', cnt - r.max, 1)
+		local at = tonumber(t[2]) + r.window
+		if at > allow then
+			allow = at
+		end
+	end
+	if r.window > longest then
+		longest = r.window
+	end
+end
+if allow > now then
+	return {0, allow}
+end
+if ARGV[3] == '1' and longest > 0 then
+	redis.call('ZADD', KEYS[2], now, ARGV[4])
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now - longest)
+	redis.call('PEXPIRE', KEYS[2], longest)
+end
+return {1, now}
+`)
+
+// 解析JSON格式的策略配置，如{"official":[{"window":"24h","max":1},{"window":"168h","max":3}]}
+func ParseCapPolicies(data []byte) (map[string][]CapRule, error) {
+	var config map[string][]capRuleConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string][]CapRule, len(config))
+	for category, rules := range config {
+		for _, r := range rules {
+			window, err := time.ParseDuration(r.Window)
+			if err != nil {
+				return nil, fmt.Errorf("msgstore: category %s: %v", category, err)
+			}
+			if window < time.Millisecond {
+				return nil, fmt.Errorf("msgstore: category %s: window %s too short", category, r.Window)
+			}
+			policies[category] = append(policies[category], CapRule{Window: window, Max: r.Max})
+		}
+	}
+
+	return policies, nil
+}
+
+// 设置一个类别的策略，rules为空时删除策略，该类别恢复默认规则，没有默认规则的不再限制
+func (this *Redis) SetCapPolicy(category string, rules []CapRule) (err error) {
+	defer this.guard("SetCapPolicy", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	key := this.Keys().CapPolicy()
+	if len(rules) == 0 {
+		_, err = rc.Do("HDEL", key, category)
+		return err
+	}
+
+	data, err := encodeCapRules(rules)
+	if err != nil {
+		return err
+	}
+
+	_, err = rc.Do("HSET", key, category, data)
+	return err
+}
+
+// 规则转为脚本使用的JSON，Window为毫秒
+func encodeCapRules(rules []CapRule) ([]byte, error) {
+	stored := make([]capRuleStored, 0, len(rules))
+	for _, r := range rules {
+		stored = append(stored, capRuleStored{Window: int64(r.Window / time.Millisecond), Max: r.Max})
+	}
+
+	return json.Marshal(stored)
+}
+
+func decodeCapRules(data []byte) ([]CapRule, error) {
+	var stored []capRuleStored
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	rules := make([]CapRule, 0, len(stored))
+	for _, r := range stored {
+		rules = append(rules, CapRule{Window: time.Duration(r.Window) * time.Millisecond, Max: r.Max})
+	}
+
+	return rules, nil
+}
+
+// 批量设置策略，一般在启动时用ParseCapPolicies读取配置文件后调用，不在其中的类别保持不变
+func (this *Redis) LoadCapPolicies(policies map[string][]CapRule) error {
+	for category, rules := range policies {
+		if err := this.SetCapPolicy(category, rules); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 读取所有类别的策略
+func (this *Redis) GetCapPolicies() (_ map[string][]CapRule, err error) {
+	defer this.guard("GetCapPolicies", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	res, err := redis.StringMap(rc.Do("HGETALL", this.Keys().CapPolicy()))
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string][]CapRule, len(res))
+	for category, data := range res {
+		rules, err := decodeCapRules([]byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("msgstore: category %s: %v", category, err)
+		}
+		policies[category] = rules
+	}
+
+	return policies, nil
+}
+
+// 读取一个类别的策略，没有配置时返回默认规则
+func (this *Redis) capRules(rc redis.Conn, category string) ([]CapRule, error) {
+	for _, k := range this.readKeys() {
+		data, err := redis.Bytes(rc.Do("HGET", k.CapPolicy(), category))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rules, err := decodeCapRules(data)
+		if err != nil {
+			return nil, fmt.Errorf("msgstore: category %s: %v", category, err)
+		}
+		return rules, nil
+	}
+
+	return defaultCapPolicies[category], nil
+}
+
+// 判断并记录一次发送，允许时记录msgid，同一个msgid重复记录只算一次，msgid为空时每次记录都单独计数
+// 不允许时返回下次允许的时间，永远不允许时为零值
+func (this *Redis) AcquireCap(subject, category, msgid string) (_ bool, _ time.Time, err error) {
+	defer this.guard("AcquireCap", &err)
+	return this.evalCap(subject, category, msgid, true)
+}
+
+// 只判断不记录，返回能否发送和下次允许的时间
+func (this *Redis) CheckCap(subject, category string) (_ bool, _ time.Time, err error) {
+	defer this.guard("CheckCap", &err)
+	return this.evalCap(subject, category, "", false)
+}
+
+func (this *Redis) evalCap(subject, category, msgid string, record bool) (bool, time.Time, error) {
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	flag := 0
+	if record {
+		flag = 1
+	}
+	if len(msgid) == 0 {
+		msgid = uniqueMember()
+	}
+
+	var defaults []byte
+	if rules := defaultCapPolicies[category]; len(rules) > 0 {
+		var err error
+		if defaults, err = encodeCapRules(rules); err != nil {
+			return false, time.Time{}, err
+		}
+	}
+
+	keys := this.Keys()
+	res, err := redis.Values(capScript.Do(rc, keys.CapPolicy(), keys.Cap(category, subject), category, nowMillis(), flag, msgid, defaults))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	var ok bool
+	var next int64
+	if _, err := redis.Scan(res, &ok, &next); err != nil {
+		return false, time.Time{}, err
+	}
+
+	if next < 0 {
+		return ok, time.Time{}, nil
+	}
+	return ok, time.Unix(0, next*int64(time.Millisecond)), nil
+}
+
+// 没有msgid时的发送记录成员，当前纳秒数加随机数，同一毫秒内的多次发送也各算一次
+func uniqueMember() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + hex.EncodeToString(b[:])
+}
+
+// 官方消息的发送记录，对象为devicekey
+func (this *Redis) officialCap(devicekey string, record bool) (bool, error) {
+	ok, _, err := this.evalCap(devicekey, CapOfficial, "", record)
+	return ok, err
+}
+
+// 按自然日判断是否达到限额，Window按天向上取整，今天和之前共Window天内发送的天数达到Max即为已满
+// 短于一天的规则只按滑动窗口计算，这里跳过
+// sent(offset)返回从今天起第offset天（负数为之前）是否发送过
+func fullByDays(rules []CapRule, sent func(offset int) (bool, error)) (bool, error) {
+	days := make(map[int]bool)
+	for _, r := range rules {
+		if r.Max <= 0 {
+			return true, nil
+		}
+		if r.Window < 24*time.Hour {
+			continue
+		}
+
+		n := int((r.Window + 24*time.Hour - 1) / (24 * time.Hour))
+		var count int64
+		for i := 0; i < n; i++ {
+			ok, seen := days[-i]
+			if !seen {
+				var err error
+				if ok, err = sent(-i); err != nil {
+					return true, err
+				}
+				days[-i] = ok
+			}
+
+			if ok {
+				count++
+			}
+			if count >= r.Max {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,131 @@
+package MsgStore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCapPolicies(t *testing.T) {
+	policies, err := ParseCapPolicies([]byte(`{"official":[{"window":"24h","max":1},{"window":"168h","max":3}],"promo":[{"window":"1h","max":5}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	official := policies["official"]
+	if len(official) != 2 || official[0] != OfficialCapRules[0] || official[1] != OfficialCapRules[1] {
+		t.Errorf("official = %v, want %v", official, OfficialCapRules)
+	}
+	if promo := policies["promo"]; len(promo) != 1 || promo[0] != (CapRule{Window: time.Hour, Max: 5}) {
+		t.Errorf("promo = %v", promo)
+	}
+
+	for _, bad := range []string{
+		`{"official":[{"window":"one day","max":1}]}`,
+		`{"official":[{"window":"0s","max":1}]}`,
+		`{"official":`,
+	} {
+		if _, err := ParseCapPolicies([]byte(bad)); err == nil {
+			t.Errorf("ParseCapPolicies(%s) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestFullByDays(t *testing.T) {
+	cases := []struct {
+		sent []int
+		full bool
+	}{
+		{nil, false},
+		{[]int{0}, true},
+		{[]int{-1, -2}, false},
+		{[]int{-1, -3, -6}, true},
+		{[]int{-1, -3, -7}, false},
+	}
+
+	for _, c := range cases {
+		days := make(map[int]bool)
+		for _, d := range c.sent {
+			days[d] = true
+		}
+
+		full, err := fullByDays(OfficialCapRules, func(offset int) (bool, error) { return days[offset], nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if full != c.full {
+			t.Errorf("sent on %v: full = %v, want %v", c.sent, full, c.full)
+		}
+	}
+
+	full, _ := fullByDays([]CapRule{{Window: time.Hour, Max: 0}}, func(int) (bool, error) { return false, nil })
+	if !full {
+		t.Error("Max 0 should always be full")
+	}
+}
+
+func TestOfficialDeviceLegacyBucket(t *testing.T) {
+	s, _ := newTestRedis(t)
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	// 改用频率限制之前按天标记的设备仍然受限
+	if _, err := rc.Do("SADD", limitDay(nil, 0).Format(limit_TM_FMT), "dev-old"); err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := s.FullOfficialDevice("dev-old")
+	if err != nil || !full {
+		t.Errorf("FullOfficialDevice = %v, %v, want full", full, err)
+	}
+}
+
+func TestOfficialDeviceVariantsAgree(t *testing.T) {
+	s, _ := newTestRedis(t)
+	far := time.FixedZone("UTC+14", 14*3600)
+
+	if n, err := s.MarkOfficialDevice("dev-1"); err != nil || n != 1 {
+		t.Fatalf("MarkOfficialDevice = %d, %v", n, err)
+	}
+	if n, err := s.MarkOfficialDeviceIn("dev-2", far); err != nil || n != 1 {
+		t.Fatalf("MarkOfficialDeviceIn = %d, %v", n, err)
+	}
+
+	for _, dev := range []string{"dev-1", "dev-2"} {
+		for _, loc := range []*time.Location{nil, time.UTC, far} {
+			full, err := s.FullOfficialDeviceIn(dev, loc)
+			if err != nil || !full {
+				t.Errorf("FullOfficialDeviceIn(%s, %v) = %v, %v, want full", dev, loc, full, err)
+			}
+		}
+		if full, err := s.FullOfficialDevice(dev); err != nil || !full {
+			t.Errorf("FullOfficialDevice(%s) = %v, %v, want full", dev, full, err)
+		}
+	}
+
+	// 已满时不再标记
+	if n, err := s.MarkOfficialDevice("dev-1"); err != nil || n != 0 {
+		t.Errorf("MarkOfficialDevice when full = %d, %v", n, err)
+	}
+}
+
+func TestAcquireCapWithoutMsgID(t *testing.T) {
+	s, _ := newTestRedis(t)
+	if err := s.SetCapPolicy("promo", []CapRule{{Window: time.Hour, Max: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有msgid的多次发送即使在同一毫秒内也各算一次
+	var allowed int
+	for i := 0; i < 3; i++ {
+		ok, _, err := s.AcquireCap("user-1", "promo", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("allowed %d sends, want 2", allowed)
+	}
+}
@@ -0,0 +1,249 @@
+package MsgStore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 过期消息的后台清理
+// 用户、设备、群组消息和_pushed、_rejected历史的ZSET在写入时登记到KeyScheme.Registry集合
+// 清理时用SSCAN分批遍历登记过的key，不再使用阻塞redis的KEYS *
+
+// 旧key方案的登记集合
+const key_ZSET_REGISTRY = "MsgStore-ZSets"
+const gc_BATCH = 100
+
+// 删除一批有序集合中的过期消息，已清空或已不存在的key从登记集合中移除
+// KEYS: registry zset...
+// ARGV: 区间数量 min max...
+var collectZSetScript = redis.NewScript(-1, `
+local removed, dropped = 0, 0
+for i = 2, #KEYS do
+	local t = redis.call('TYPE', KEYS[i]).ok
+	if t == 'zset' then
+		for j = 1, tonumber(ARGV[1]) do
+			removed = removed + redis.call('ZREMRANGEBYSCORE', KEYS[i], ARGV[2 * j], ARGV[2 * j + 1])
+		end
+	end
+	if t ~= 'zset' or redis.call('ZCARD', KEYS[i]) == 0 then
+		redis.call('SREM', KEYS[1], KEYS[i])
+		dropped = dropped + 1
+	end
+end
+return {removed, dropped}
+`)
+
+// 执行写有序集合的命令并把key登记到registry
+// 登记在写入之后，保证清理脚本不会在两者之间把key移出登记集合
+func doRegistered(rc redis.Conn, registry, key string, cmd string, args ...interface{}) (interface{}, error) {
+	if err := rc.Send(cmd, args...); err != nil {
+		return nil, err
+	}
+	if err := rc.Send("SADD", registry, key); err != nil {
+		return nil, err
+	}
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+
+	reply, err := rc.Receive()
+	if _, e := rc.Receive(); err == nil {
+		err = e
+	}
+
+	return reply, err
+}
+
+// 把已有的匹配match的有序集合登记到当前key方案的登记集合，用于登记机制上线前写入的key
+// 依赖redis 6.0的SCAN TYPE，返回新登记的数量
+func (this *Redis) RegisterZSets(match string) (_ int64, err error) {
+	defer this.guard("RegisterZSets", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	registry := this.Keys().Registry()
+	var count int64
+	cursor := int64(0)
+	for {
+		res, err := redis.Values(rc.Do("SCAN", cursor, "MATCH", match, "COUNT", 1000, "TYPE", "zset"))
+		if err != nil {
+			return count, err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(res, &cursor, &keys); err != nil {
+			return count, err
+		}
+
+		if len(keys) > 0 {
+			c, err := redis.Int64(rc.Do("SADD", redis.Args{registry}.AddFlat(keys)...))
+			if err != nil {
+				return count, err
+			}
+			count += c
+		}
+
+		if cursor == 0 {
+			return count, nil
+		}
+	}
+}
+
+// 清理从cursor开始的一批登记在registry中的有序集合
+// 返回下一个cursor、处理的key数量、删除的消息数量和移出登记的key数量
+func (this *Redis) collectZSets(registry string, cursor int64, batch int, deadline time.Time) (next int64, n int, removed, dropped int64, err error) {
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	res, err := redis.Values(rc.Do("SSCAN", registry, cursor, "COUNT", batch))
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	var keys []string
+	if _, err = redis.Scan(res, &next, &keys); err != nil || len(keys) == 0 {
+		return next, 0, 0, 0, err
+	}
+
+	args := redis.Args{1 + len(keys), registry}.AddFlat(keys)
+	args = append(args, this.rangeArgs(time.Time{}, deadline)...)
+	res, err = redis.Values(collectZSetScript.Do(rc, args...))
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	_, err = redis.Scan(res, &removed, &dropped)
+	return next, len(keys), removed, dropped, err
+}
+
+// 后台清理的参数，零值字段使用默认值
+type GCOption struct {
+	KeepTime      time.Duration // 过期后仍然继续存储的时间
+	Batch         int           // 每批处理的key数量
+	KeysPerSecond int           // 每秒最多处理的key数量，0表示不限速
+	Interval      time.Duration // 两轮完整遍历之间的间隔
+}
+
+// 后台清理的进度和统计
+type GCStats struct {
+	Running   bool
+	Rounds    int64     // 完成的完整遍历轮数
+	Keys      int64     // 处理过的key数量
+	Removed   int64     // 删除的过期消息数量
+	Dropped   int64     // 移出登记集合的key数量
+	Errors    int64     // 出错的批次数量
+	Cursor    int64     // 当前轮的遍历位置
+	LastRound time.Time // 上一轮完成的时间
+}
+
+type collector struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	stats  GCStats
+}
+
+// 启动后台清理，已在运行时返回错误
+func (this *Redis) StartGC(opt GCOption) error {
+	this.gc.mu.Lock()
+	defer this.gc.mu.Unlock()
+
+	if this.gc.stats.Running {
+		return errors.New("gc is already running")
+	}
+
+	if opt.Batch <= 0 {
+		opt.Batch = gc_BATCH
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	this.gc.cancel = cancel
+	this.gc.done = make(chan struct{})
+	this.gc.stats.Running = true
+	go this.runGC(ctx, opt, this.gc.done)
+	return nil
+}
+
+// 停止后台清理并等待当前批次结束
+func (this *Redis) StopGC() {
+	this.gc.mu.Lock()
+	cancel, done := this.gc.cancel, this.gc.done
+	this.gc.cancel, this.gc.done = nil, nil
+	this.gc.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// 获取后台清理的进度和统计
+func (this *Redis) GCStats() GCStats {
+	this.gc.mu.Lock()
+	defer this.gc.mu.Unlock()
+
+	return this.gc.stats
+}
+
+func (this *Redis) runGC(ctx context.Context, opt GCOption, done chan struct{}) {
+	defer close(done)
+	defer func() {
+		this.gc.mu.Lock()
+		this.gc.stats.Running = false
+		this.gc.mu.Unlock()
+	}()
+
+	cursor := int64(0)
+	var deadline time.Time
+	for ctx.Err() == nil {
+		// 每轮开始时先把过期未送达的消息收集为死信，收集出错时本轮不开始
+		// 一轮内的删除期限固定为收集之前的时间，不会删除收集时还未过期的消息
+		var err error
+		if cursor == 0 {
+			deadline = time.Now().Add(-opt.KeepTime)
+			_, err = this.CollectExpired()
+		}
+
+		var next int64
+		var n int
+		var removed, dropped int64
+		if err == nil {
+			next, n, removed, dropped, err = this.collectZSets(this.Keys().Registry(), cursor, opt.Batch, deadline)
+		}
+
+		this.gc.mu.Lock()
+		if err != nil {
+			this.gc.stats.Errors++
+		} else {
+			cursor = next
+			this.gc.stats.Keys += int64(n)
+			this.gc.stats.Removed += removed
+			this.gc.stats.Dropped += dropped
+			if cursor == 0 {
+				this.gc.stats.Rounds++
+				this.gc.stats.LastRound = time.Now()
+			}
+		}
+		this.gc.stats.Cursor = cursor
+		this.gc.mu.Unlock()
+
+		// 出错时等一轮间隔再重试，一轮结束后等待下一轮，否则按速率限制等待
+		wait := opt.Interval
+		if err == nil && cursor != 0 {
+			wait = 0
+			if opt.KeysPerSecond > 0 {
+				wait = time.Second * time.Duration(n) / time.Duration(opt.KeysPerSecond)
+			}
+		}
+		if wait > 0 && !sleepContext(ctx, wait) {
+			return
+		}
+	}
+}
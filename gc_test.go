@@ -0,0 +1,83 @@
+package MsgStore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestClearOutDateMsg(t *testing.T) {
+	s, _ := newTestRedis(t)
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	// 5001只有过期消息，5002还有未过期的
+	if _, err := s.NewUserMsg(5001, -10, "o-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewUserMsg(5002, -10, "o-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewUserMsg(5002, 60, "o-3"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.ClearOutDateMsg(0)
+	expectInt(t, "ClearOutDateMsg", n, err, 2)
+
+	ids, err := s.GetUserMsg(5002)
+	expectIDs(t, "GetUserMsg", ids, err, "o-3")
+
+	// 已清空的key移出登记集合
+	keys, err := redis.Strings(rc.Do("SMEMBERS", s.Keys().Registry()))
+	expectIDs(t, "registry", keys, err, s.Keys().User(5002))
+}
+
+func TestRegisterZSets(t *testing.T) {
+	s, _ := newTestRedis(t)
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	// 登记机制上线前写入的key
+	if _, err := rc.Do("ZADD", "5003", s.score(time.Now().Add(-time.Minute)), "o-4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Do("SET", "5004", "not a zset"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.RegisterZSets("500*")
+	expectInt(t, "RegisterZSets", n, err, 1)
+
+	n, err = s.ClearOutDateMsg(0)
+	expectInt(t, "ClearOutDateMsg", n, err, 1)
+}
+
+func TestBackgroundGC(t *testing.T) {
+	s, _ := newTestRedis(t)
+	for i := int64(0); i < 5; i++ {
+		if _, err := s.NewUserMsg(5010+i, -10, "o-5"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.StartGC(GCOption{Batch: 2, Interval: 5 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartGC(GCOption{}); err == nil {
+		t.Error("StartGC while running should fail")
+	}
+
+	// miniredis的SSCAN按位置分页，本轮移出登记的key会使后面的key留到下一轮
+	deadline := time.Now().Add(2 * time.Second)
+	for s.GCStats().Removed < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.StopGC()
+
+	stats := s.GCStats()
+	if stats.Running || stats.Rounds == 0 || stats.Removed != 5 || stats.Dropped != 5 || stats.Errors != 0 {
+		t.Errorf("GCStats = %+v", stats)
+	}
+}
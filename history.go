@@ -0,0 +1,151 @@
+package MsgStore
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 用户消息的发送历史，_pushed和_rejected有序集合在MarkUserMsg写入时按数量和时间淘汰
+// GetUserHistory按时间范围分页查询已发送、已拒绝和已超时的消息
+
+const (
+	HistoryPushed   = "pushed"
+	HistoryRejected = "rejected"
+	HistoryExpired  = "expired"
+)
+
+// 历史保留策略，零值字段表示不限制
+type HistoryRetention struct {
+	MaxCount int64         // 每个用户每种历史最多保留的消息数量
+	MaxAge   time.Duration // 最长保留时间，同时作为历史集合的生存周期
+}
+
+// 一条历史，已发送和已拒绝的Time为标记时间，已超时的Time为消息的生命终点
+type HistoryItem struct {
+	MsgID string
+	State string
+	Time  time.Time
+}
+
+// 历史查询条件，Start、End为零值时不限制，结果按时间从新到旧排列
+type HistoryQuery struct {
+	Start  time.Time
+	End    time.Time
+	Offset int
+	Limit  int // 小于等于0时返回全部
+}
+
+// 设置发送历史的保留策略，之后的MarkUserMsg按新策略淘汰
+func (this *Redis) SetHistoryRetention(r HistoryRetention) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.retention = r
+}
+
+func (this *Redis) historyRetention() HistoryRetention {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.retention
+}
+
+// 按保留策略淘汰历史，调用方已写入新的历史
+func (this *Redis) trimHistory(rc redis.Conn, history string) error {
+	r := this.historyRetention()
+	if r.MaxCount <= 0 && r.MaxAge <= 0 {
+		return nil
+	}
+
+	if r.MaxAge > 0 {
+		cutoff := time.Now().Add(-r.MaxAge - time.Millisecond)
+		for _, sr := range this.scores().Ranges(time.Time{}, cutoff) {
+			rc.Send("ZREMRANGEBYSCORE", history, sr.Min, sr.Max)
+		}
+		rc.Send("EXPIRE", history, int64(r.MaxAge/time.Second)+1)
+	}
+	if r.MaxCount > 0 {
+		rc.Send("ZREMRANGEBYRANK", history, 0, -r.MaxCount-1)
+	}
+
+	return replyErr(rc.Do(""))
+}
+
+// 分页查询用户消息的发送历史
+func (this *Redis) GetUserHistory(userid int64, q HistoryQuery) (_ []*HistoryItem, err error) {
+	defer this.guard("GetUserHistory", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	// 已超时的消息是用户消息集合中生命终点早于当前时间的部分
+	outEnd := q.End
+	if now := time.Now(); q.End.IsZero() || q.End.After(now) {
+		outEnd = now.Add(-time.Millisecond)
+	}
+
+	// 每个来源最多取Offset+Limit个，合并排序后再分页
+	count := -1
+	if q.Limit > 0 {
+		count = q.Offset + q.Limit
+	}
+
+	sources := []struct {
+		state  string
+		keys   []string
+		ranges []ScoreRange
+	}{
+		{HistoryPushed, this.readKeysOf(func(k KeyScheme) string { return k.Pushed(userid) }), this.scores().Ranges(q.Start, q.End)},
+		{HistoryRejected, this.readKeysOf(func(k KeyScheme) string { return k.Rejected(userid) }), this.scores().Ranges(q.Start, q.End)},
+		{HistoryExpired, this.readKeysOf(func(k KeyScheme) string { return k.User(userid) }), this.scores().Ranges(q.Start, outEnd)},
+	}
+
+	var items []*HistoryItem
+	seen := make(map[string]bool)
+	for _, src := range sources {
+		for _, key := range src.keys {
+			for _, sr := range src.ranges {
+				res, err := redis.Strings(rc.Do("ZREVRANGEBYSCORE", key, sr.Max, sr.Min, "WITHSCORES", "LIMIT", 0, count))
+				if err != nil {
+					return nil, err
+				}
+
+				for i := 0; i+1 < len(res); i += 2 {
+					if seen[src.state+res[i]] {
+						continue
+					}
+					seen[src.state+res[i]] = true
+
+					score, err := strconv.ParseFloat(res[i+1], 64)
+					if err != nil {
+						return nil, err
+					}
+					items = append(items, &HistoryItem{MsgID: res[i], State: src.state, Time: DecodeScore(score)})
+				}
+			}
+		}
+	}
+
+	return pageHistory(items, q), nil
+}
+
+// 按时间从新到旧排序后分页
+func pageHistory(items []*HistoryItem, q HistoryQuery) []*HistoryItem {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Time.After(items[j].Time)
+	})
+
+	if q.Offset >= len(items) {
+		return nil
+	}
+	if q.Offset > 0 {
+		items = items[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit < len(items) {
+		items = items[:q.Limit]
+	}
+
+	return items
+}
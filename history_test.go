@@ -0,0 +1,39 @@
+package MsgStore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPageHistory(t *testing.T) {
+	base := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	items := func() []*HistoryItem {
+		return []*HistoryItem{
+			{MsgID: "a", Time: base.Add(1 * time.Minute)},
+			{MsgID: "c", Time: base.Add(3 * time.Minute)},
+			{MsgID: "b", Time: base.Add(2 * time.Minute)},
+			{MsgID: "d", Time: base.Add(4 * time.Minute)},
+		}
+	}
+
+	cases := []struct {
+		q    HistoryQuery
+		want string
+	}{
+		{HistoryQuery{}, "dcba"},
+		{HistoryQuery{Limit: 2}, "dc"},
+		{HistoryQuery{Offset: 1, Limit: 2}, "cb"},
+		{HistoryQuery{Offset: 3, Limit: 2}, "a"},
+		{HistoryQuery{Offset: 4}, ""},
+	}
+
+	for _, c := range cases {
+		var got string
+		for _, item := range pageHistory(items(), c.q) {
+			got += item.MsgID
+		}
+		if got != c.want {
+			t.Errorf("%+v: got %q, want %q", c.q, got, c.want)
+		}
+	}
+}
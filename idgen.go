@@ -0,0 +1,169 @@
+package MsgStore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 高吞吐的消息ID分配，减少NewMsgID每个消息一次INCR的开销
+// BlockAllocator: 用INCRBY一次租用一段ID在本地分配，与NewMsgID共用计数器，进程重启时未用完的ID被丢弃，不会重复
+// TimeAllocator: 毫秒时间戳+节点号+序号，不同key的ID也按创建时间排序
+
+// 按段租用的ID分配器
+type BlockAllocator struct {
+	store *Redis
+	key   string
+	block int64
+
+	mu   sync.Mutex
+	next int64
+	end  int64
+}
+
+// 每次租用block个ID，block越大redis访问越少，进程重启时浪费的ID越多
+func (this *Redis) NewBlockAllocator(key string, block int64) *BlockAllocator {
+	if block < 1 {
+		block = 1
+	}
+
+	return &BlockAllocator{store: this, key: key, block: block}
+}
+
+// 分配一个ID，本段用完时向redis租用下一段
+func (this *BlockAllocator) Next() (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.next == 0 || this.next > this.end {
+		if err := this.lease(); err != nil {
+			return 0, err
+		}
+	}
+
+	id := this.next
+	this.next++
+	return id, nil
+}
+
+func (this *BlockAllocator) lease() (err error) {
+	defer this.store.guard("BlockAllocator", &err)
+	rc := this.store.pool.Get()
+	defer rc.Close()
+
+	end, err := redis.Int64(rc.Do("INCRBY", this.store.Keys().MsgID(this.key), this.block))
+	if err != nil {
+		return err
+	}
+
+	this.next, this.end = end-this.block+1, end
+	return nil
+}
+
+// 时间有序ID的组成：41位毫秒时间戳（从time_ID_EPOCH开始）、10位节点号、12位毫秒内序号
+const (
+	time_ID_NODE_BITS = 10
+	time_ID_SEQ_BITS  = 12
+	time_ID_MAX_NODE  = 1<<time_ID_NODE_BITS - 1
+	time_ID_MAX_SEQ   = 1<<time_ID_SEQ_BITS - 1
+
+	// 向redis预留时间窗口的长度，毫秒
+	time_ID_WINDOW = 10000
+)
+
+// 2020-01-01 00:00:00 UTC
+var time_ID_EPOCH = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+
+// 预留时间窗口，返回可以使用的起始毫秒数和窗口结束的毫秒数
+// 起始毫秒数不小于之前所有进程预留过的窗口结束，时钟回拨或进程重启后也不会生成重复的ID
+// KEYS: 节点的预留记录
+// ARGV: 需要的最小毫秒数 窗口长度
+var reserveTimeIDScript = redis.NewScript(1, `
+local start = tonumber(ARGV[1])
+local hwm = tonumber(redis.call('GET', KEYS[1]) or '0')
+if hwm > start then
+	start = hwm
+end
+local stop = start + tonumber(ARGV[2])
+redis.call('SET', KEYS[1], stop)
+return {start, stop}
+`)
+
+// 时间有序的ID分配器，同一个key下每个进程需要使用不同的node
+type TimeAllocator struct {
+	store *Redis
+	key   string
+	node  int64
+
+	mu       sync.Mutex
+	last     int64 // 上一个ID的毫秒数
+	seq      int64
+	reserved int64 // 已预留的窗口结束，ID的毫秒数必须小于它
+}
+
+// node取值0-1023，同一个key下同时运行的进程不能使用相同的node
+func (this *Redis) NewTimeAllocator(key string, node int64) (*TimeAllocator, error) {
+	if node < 0 || node > time_ID_MAX_NODE {
+		return nil, fmt.Errorf("msgstore: node %d out of range [0, %d]", node, time_ID_MAX_NODE)
+	}
+
+	return &TimeAllocator{store: this, key: key, node: node}, nil
+}
+
+// 分配一个ID，毫秒内序号用完或时钟回拨时借用后面的毫秒数
+func (this *TimeAllocator) Next() (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	ms := time.Now().UnixNano()/int64(time.Millisecond) - time_ID_EPOCH
+	switch {
+	case this.reserved == 0 || ms > this.last:
+		this.seq = 0
+	case this.seq < time_ID_MAX_SEQ:
+		ms = this.last
+		this.seq++
+	default:
+		ms = this.last + 1
+		this.seq = 0
+	}
+
+	if ms >= this.reserved {
+		start, err := this.reserve(ms)
+		if err != nil {
+			return 0, err
+		}
+		if start > ms {
+			ms, this.seq = start, 0
+		}
+	}
+
+	this.last = ms
+	return ms<<(time_ID_NODE_BITS+time_ID_SEQ_BITS) | this.node<<time_ID_SEQ_BITS | this.seq, nil
+}
+
+func (this *TimeAllocator) reserve(ms int64) (_ int64, err error) {
+	defer this.store.guard("TimeAllocator", &err)
+	rc := this.store.pool.Get()
+	defer rc.Close()
+
+	key := fmt.Sprintf("%s:node:%d", this.store.Keys().MsgID(this.key), this.node)
+	res, err := redis.Values(reserveTimeIDScript.Do(rc, key, ms, time_ID_WINDOW))
+	if err != nil {
+		return 0, err
+	}
+
+	var start int64
+	if _, err := redis.Scan(res, &start, &this.reserved); err != nil {
+		return 0, err
+	}
+
+	return start, nil
+}
+
+// 从时间有序的ID中取出创建时间
+func TimeOfID(id int64) time.Time {
+	ms := id>>(time_ID_NODE_BITS+time_ID_SEQ_BITS) + time_ID_EPOCH
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,44 @@
+package MsgStore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeIDLayout(t *testing.T) {
+	if bits := 41 + time_ID_NODE_BITS + time_ID_SEQ_BITS; bits != 63 {
+		t.Fatalf("id uses %d bits, want 63", bits)
+	}
+
+	tm := time.Date(2024, 3, 5, 10, 20, 30, 123*int(time.Millisecond), time.UTC)
+	ms := tm.UnixNano()/int64(time.Millisecond) - time_ID_EPOCH
+	id := ms<<(time_ID_NODE_BITS+time_ID_SEQ_BITS) | time_ID_MAX_NODE<<time_ID_SEQ_BITS | time_ID_MAX_SEQ
+
+	if got := TimeOfID(id); !got.Equal(tm) {
+		t.Errorf("TimeOfID = %v, want %v", got, tm)
+	}
+	if node := id >> time_ID_SEQ_BITS & time_ID_MAX_NODE; node != time_ID_MAX_NODE {
+		t.Errorf("node = %d, want %d", node, time_ID_MAX_NODE)
+	}
+	if seq := id & time_ID_MAX_SEQ; seq != time_ID_MAX_SEQ {
+		t.Errorf("seq = %d, want %d", seq, time_ID_MAX_SEQ)
+	}
+
+	// 41位毫秒时间戳从time_ID_EPOCH起可用约69年
+	last := TimeOfID(1<<63 - 1)
+	if last.Year() < 2089 {
+		t.Errorf("ids run out in %d", last.Year())
+	}
+}
+
+func TestNewTimeAllocatorNode(t *testing.T) {
+	store := new(Redis)
+	for _, node := range []int64{-1, time_ID_MAX_NODE + 1} {
+		if _, err := store.NewTimeAllocator("id", node); err == nil {
+			t.Errorf("node %d accepted", node)
+		}
+	}
+	if _, err := store.NewTimeAllocator("id", time_ID_MAX_NODE); err != nil {
+		t.Errorf("node %d: %v", time_ID_MAX_NODE, err)
+	}
+}
@@ -0,0 +1,177 @@
+package MsgStore
+
+import (
+	"fmt"
+	"time"
+)
+
+// key的命名方案，所有key都由KeyScheme构造
+// Prefix为空时是旧方案：用户ID、设备key、群组key、msgid直接作为key，与其他功能共用一个库
+// Prefix不为空时按功能加前缀，如msg:user:<userid>、msg:group:<key>，可以按前缀查看和淘汰
+type KeyScheme struct {
+	Prefix string
+}
+
+// 旧的key方案
+var legacyKeys = KeyScheme{}
+
+func (k KeyScheme) legacy() bool {
+	return len(k.Prefix) == 0
+}
+
+func (k KeyScheme) join(kind string, id interface{}) string {
+	return fmt.Sprintf("%s:%s:%v", k.Prefix, kind, id)
+}
+
+// INCR生成msgid的计数器
+func (k KeyScheme) MsgID(key string) string {
+	if k.legacy() {
+		return key
+	}
+	return k.join("id", key)
+}
+
+// 请求哈希值和消息ID的映射
+func (k KeyScheme) Request(key string) string {
+	if k.legacy() {
+		return key
+	}
+	return k.join("request", key)
+}
+
+// 广播队列
+func (k KeyScheme) Queue(queue string) string {
+	if k.legacy() {
+		return queue
+	}
+	return k.join("queue", queue)
+}
+
+// 延时消息有序集合
+func (k KeyScheme) Lazy(set string) string {
+	if k.legacy() {
+		return set
+	}
+	return k.join("lazy", set)
+}
+
+// 群组消息有序集合
+func (k KeyScheme) Group(key string) string {
+	if k.legacy() {
+		return key
+	}
+	return k.join("group", key)
+}
+
+// 群组消息的用户标记集合，key为前缀加msgid，服务端脚本按同样的规则拼接
+func (k KeyScheme) GroupMark(msgid string) string {
+	return k.groupMarkPrefix() + msgid
+}
+
+func (k KeyScheme) groupMarkPrefix() string {
+	if k.legacy() {
+		return ""
+	}
+	return k.Prefix + ":groupmark:"
+}
+
+// 设备消息有序集合
+func (k KeyScheme) Device(devicekey string) string {
+	if k.legacy() {
+		return devicekey
+	}
+	return k.join("device", devicekey)
+}
+
+// 用户消息有序集合
+func (k KeyScheme) User(userid int64) string {
+	if k.legacy() {
+		return fmt.Sprint(userid)
+	}
+	return k.join("user", userid)
+}
+
+// 用户已发送消息的历史
+func (k KeyScheme) Pushed(userid int64) string {
+	if k.legacy() {
+		return fmt.Sprintf("%v_pushed", userid)
+	}
+	return k.join("user", userid) + ":pushed"
+}
+
+// 用户已拒绝消息的历史
+func (k KeyScheme) Rejected(userid int64) string {
+	if k.legacy() {
+		return fmt.Sprintf("%v_rejected", userid)
+	}
+	return k.join("user", userid) + ":rejected"
+}
+
+// 消息Ack计数的HASH
+func (k KeyScheme) Ack(hashtable string) string {
+	if k.legacy() {
+		return hashtable
+	}
+	return k.join("ack", hashtable)
+}
+
+// 官方消息标记
+func (k KeyScheme) Official(msgid string) string {
+	if k.legacy() {
+		return key_OFFICIAL + msgid
+	}
+	return k.join("official", msgid)
+}
+
+// 官方消息的每日设备限额集合，日期按day所在的时区计算
+func (k KeyScheme) Limit(day time.Time) string {
+	if k.legacy() {
+		return day.Format(limit_TM_FMT)
+	}
+	return k.join("limit", day.Format("20060102"))
+}
+
+// 消息信封
+func (k KeyScheme) Envelope(msgid string) string {
+	if k.legacy() {
+		return key_ENVELOPE + msgid
+	}
+	return k.join("envelope", msgid)
+}
+
+// 需要清理的有序集合的登记集合
+func (k KeyScheme) Registry() string {
+	if k.legacy() {
+		return key_ZSET_REGISTRY
+	}
+	return k.Prefix + ":zsets"
+}
+
+// 使用新的key方案，dualRead为true时读操作同时读取旧key，写操作只写新key
+// 用于迁移期间的兼容，MigrateLegacyKeys完成后再关闭dualRead
+func (this *Redis) UseKeyScheme(keys KeyScheme, dualRead bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.keys = keys
+	this.dualRead = dualRead && !keys.legacy()
+}
+
+// 当前写入使用的key方案
+func (this *Redis) Keys() KeyScheme {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.keys
+}
+
+// 读操作需要读取的key方案，新方案在前
+func (this *Redis) readKeys() []KeyScheme {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if this.dualRead {
+		return []KeyScheme{this.keys, legacyKeys}
+	}
+	return []KeyScheme{this.keys}
+}
@@ -0,0 +1,37 @@
+package MsgStore
+
+import (
+	"time"
+)
+
+// 官方消息每日限额按设备所在时区的自然日划分
+// 每日集合的key是该时区下的日期，如Limit-20060102，与服务器时区无关，不同时区的服务器对同一设备得到相同的key
+// 同一个集合中的设备可能来自不同时区，各自表示本地的同一个日期
+
+// 设置MarkOfficialDevice、FullOfficialDevice和loc为nil的*In方法划分自然日的默认时区，nil为UTC
+// 只影响按自然日计算的部分，滑动窗口与时区无关
+// 默认时区与服务器时区无关，不同时区部署的服务器得到相同的日期划分
+func (this *Redis) SetLimitLocation(loc *time.Location) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.limitLoc = loc
+}
+
+func (this *Redis) limitLocation() *time.Location {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.limitLoc
+}
+
+// loc时区下从今天起第offset天（负数为之前）的日期，loc为nil时使用UTC
+// 取当天中午，用time.Date处理跨月和夏令时切换日
+func limitDay(loc *time.Location, offset int) time.Time {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	now := time.Now().In(loc)
+	return time.Date(now.Year(), now.Month(), now.Day()+offset, 12, 0, 0, 0, loc)
+}
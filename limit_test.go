@@ -0,0 +1,53 @@
+package MsgStore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestLimitDay(t *testing.T) {
+	today := limitDay(nil, 0)
+	if today.Location() != time.UTC {
+		t.Errorf("nil location: got %v, want UTC", today.Location())
+	}
+	if today.Hour() != 12 {
+		t.Errorf("hour = %d, want 12", today.Hour())
+	}
+
+	now := time.Now().UTC()
+	if today.Year() != now.Year() || today.YearDay() != now.YearDay() {
+		t.Errorf("today = %v, now = %v", today, now)
+	}
+
+	yesterday := today.AddDate(0, 0, -1)
+	if got := limitDay(nil, -1); !got.Equal(yesterday) {
+		t.Errorf("offset -1 = %v, want %v", got, yesterday)
+	}
+
+	// 与UTC相差14小时的时区，日期可能与UTC不同
+	loc := time.FixedZone("UTC+14", 14*3600)
+	local := time.Now().In(loc)
+	if got := limitDay(loc, 0); got.Format(limit_TM_FMT) != local.Format(limit_TM_FMT) {
+		t.Errorf("UTC+14 day = %s, want %s", got.Format(limit_TM_FMT), local.Format(limit_TM_FMT))
+	}
+}
+
+func TestSetLimitLocation(t *testing.T) {
+	s, _ := newTestRedis(t)
+	loc := time.FixedZone("UTC+14", 14*3600)
+	s.SetLimitLocation(loc)
+
+	if _, err := s.MarkOfficialDevice("dev-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := s.pool.Get()
+	defer rc.Close()
+
+	ok, err := redis.Bool(rc.Do("SISMEMBER", s.Keys().Limit(limitDay(loc, 0)), "dev-1"))
+	if err != nil || !ok {
+		t.Errorf("device not in the %s bucket of the default location: %v, %v", limitDay(loc, 0).Format(limit_TM_FMT), ok, err)
+	}
+}
@@ -0,0 +1,186 @@
+package MsgStore
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// 群组成员，成员为userFlag，与群组消息标记集合中的userFlag相同
+// 群组消息的送达覆盖率由成员集合和该消息的标记集合求交集得到
+
+const key_MEMBERS = "Members-"
+
+// 群组的成员集合
+func (k KeyScheme) Members(key string) string {
+	return k.membersPrefix() + key
+}
+
+func (k KeyScheme) membersPrefix() string {
+	if k.legacy() {
+		return key_MEMBERS
+	}
+	return k.Prefix + ":members:"
+}
+
+// 统计成员中收到过消息的数量，成员为所有成员集合的并集，在任一标记集合中都算收到过
+// KEYS: 成员集合... 标记集合...
+// ARGV: 成员集合数量 是否返回未收到的成员
+// 返回{收到过的成员数, 成员总数, 未收到的成员}
+var groupCoverageScript = redis.NewScript(-1, `
+local n = tonumber(ARGV[1])
+local seen, undelivered = {}, {}
+local delivered, total = 0, 0
+for i = 1, n do
+	for _, m in ipairs(redis.call('SMEMBERS', KEYS[i])) do
+		if not seen[m] then
+			seen[m] = true
+			total = total + 1
+			local marked = false
+			for j = n + 1, #KEYS do
+				if redis.call('SISMEMBER', KEYS[j], m) == 1 then
+					marked = true
+					break
+				end
+			end
+			if marked then
+				delivered = delivered + 1
+			elseif ARGV[2] == '1' then
+				undelivered[#undelivered + 1] = m
+			end
+		end
+	end
+end
+return {delivered, total, undelivered}
+`)
+
+// 群组消息的送达覆盖率
+type GroupCoverage struct {
+	Delivered int64 // 收到过消息的成员数
+	Members   int64 // 成员总数
+}
+
+// 加入群组，返回新加入的数量
+func (this *Redis) JoinGroup(key string, userFlags ...string) (_ int64, err error) {
+	if len(userFlags) == 0 {
+		return 0, nil
+	}
+
+	defer this.guard("JoinGroup", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return redis.Int64(rc.Do("SADD", redis.Args{this.Keys().Members(key)}.AddFlat(userFlags)...))
+}
+
+// 退出群组，返回退出的数量
+func (this *Redis) LeaveGroup(key string, userFlags ...string) (_ int64, err error) {
+	if len(userFlags) == 0 {
+		return 0, nil
+	}
+
+	defer this.guard("LeaveGroup", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	var count int64
+	for _, k := range this.readKeys() {
+		n, err := redis.Int64(rc.Do("SREM", redis.Args{k.Members(key)}.AddFlat(userFlags)...))
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+
+	return count, nil
+}
+
+// 获取群组的所有成员
+func (this *Redis) GetGroupMembers(key string) (_ []string, err error) {
+	defer this.guard("GetGroupMembers", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.Members(key) })
+	return redis.Strings(rc.Do("SUNION", redis.Args{}.AddFlat(keys)...))
+}
+
+// 群组成员数量
+func (this *Redis) CountGroupMembers(key string) (_ int64, err error) {
+	defer this.guard("CountGroupMembers", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.Members(key) })
+	if len(keys) == 1 {
+		return redis.Int64(rc.Do("SCARD", keys[0]))
+	}
+
+	// 迁移期间同一成员可能在新旧两个集合中
+	members, err := redis.Strings(rc.Do("SUNION", redis.Args{}.AddFlat(keys)...))
+	return int64(len(members)), err
+}
+
+// 是否为群组成员
+func (this *Redis) IsGroupMember(key, userFlag string) (_ bool, err error) {
+	defer this.guard("IsGroupMember", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	for _, k := range this.readKeys() {
+		ok, err := redis.Bool(rc.Do("SISMEMBER", k.Members(key), userFlag))
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+
+	return false, nil
+}
+
+// 以成员身份获取需要发送的群组消息，不是成员时返回ErrNotMember
+func (this *Redis) GetMemberGroupMsg(key, userFlag string) ([]string, error) {
+	ok, err := this.IsGroupMember(key, userFlag)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotMember
+	}
+
+	return this.GetGroupMsg(key, userFlag)
+}
+
+// 群组消息在当前成员中的送达覆盖率
+// 统计需要遍历成员集合，成员很多的群组应避免频繁调用
+func (this *Redis) GetGroupCoverage(key, msgid string) (_ *GroupCoverage, err error) {
+	defer this.guard("GetGroupCoverage", &err)
+	c, _, err := this.groupCoverage(key, msgid, false)
+	return c, err
+}
+
+// 获取尚未收到群组消息的成员
+func (this *Redis) GetUndeliveredMembers(key, msgid string) (_ []string, err error) {
+	defer this.guard("GetUndeliveredMembers", &err)
+	_, undelivered, err := this.groupCoverage(key, msgid, true)
+	return undelivered, err
+}
+
+func (this *Redis) groupCoverage(key, msgid string, list bool) (*GroupCoverage, []string, error) {
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	members := this.readKeysOf(func(k KeyScheme) string { return k.Members(key) })
+	marks := this.readKeysOf(func(k KeyScheme) string { return k.GroupMark(msgid) })
+	args := redis.Args{len(members) + len(marks)}.AddFlat(members).AddFlat(marks)
+	args = args.Add(len(members), list)
+	res, err := redis.Values(groupCoverageScript.Do(rc, args...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := new(GroupCoverage)
+	var undelivered []string
+	if _, err := redis.Scan(res, &c.Delivered, &c.Members, &undelivered); err != nil {
+		return nil, nil, err
+	}
+
+	return c, undelivered, nil
+}
@@ -0,0 +1,1157 @@
+package MsgStore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MsgStore的内存实现，语义与Redis一致：key的生存周期、有序集合按score和成员排序
+// 有序集合的score直接保存时间，不需要NumberTime编码
+// 所有数据都在一把锁下，只适合测试和单机小规模部署
+type Memory struct {
+	mu sync.Mutex
+
+	expires  map[string]time.Time
+	strings  map[string]string
+	counters map[string]int64
+	lists    map[string][][]byte
+	zsets    map[string]map[string]time.Time
+	sets     map[string]map[string]bool
+	hashes   map[string]map[string]int64
+	envs     map[string]*Envelope
+
+	// 与key_ZSET_REGISTRY相同，记录需要ClearOutDateMsg清理的有序集合
+	registry map[string]bool
+
+	// 用户消息发送历史的保留策略
+	retention HistoryRetention
+
+	// 是否登记消息写入的有序集合，供RecallMsg撤回
+	recall bool
+
+	// 频率限制的策略，没有配置的类别使用默认规则
+	caps map[string][]CapRule
+}
+
+func NewMemoryStore() *Memory {
+	return &Memory{
+		expires:  make(map[string]time.Time),
+		strings:  make(map[string]string),
+		counters: make(map[string]int64),
+		lists:    make(map[string][][]byte),
+		zsets:    make(map[string]map[string]time.Time),
+		sets:     make(map[string]map[string]bool),
+		hashes:   make(map[string]map[string]int64),
+		envs:     make(map[string]*Envelope),
+		registry: make(map[string]bool),
+	}
+}
+
+// 检查key是否过期，过期的key被删除，调用方需持有锁
+func (this *Memory) expire(key string) {
+	if tm, ok := this.expires[key]; ok && !time.Now().Before(tm) {
+		this.del(key)
+	}
+}
+
+func (this *Memory) del(key string) {
+	delete(this.expires, key)
+	delete(this.strings, key)
+	delete(this.counters, key)
+	delete(this.lists, key)
+	delete(this.zsets, key)
+	delete(this.sets, key)
+	delete(this.hashes, key)
+	delete(this.envs, key)
+}
+
+// 剩余生存秒数，与TTL命令一致：不存在返回-2，没有生存周期返回-1
+func (this *Memory) ttl(key string) int64 {
+	this.expire(key)
+	if tm, ok := this.expires[key]; ok {
+		return int64(time.Until(tm) / time.Second)
+	}
+	if _, ok := this.sets[key]; ok {
+		return -1
+	}
+
+	return -2
+}
+
+func (this *Memory) setExpire(key string, ttl time.Duration) {
+	this.expires[key] = time.Now().Add(ttl)
+}
+
+func (this *Memory) zadd(key string, tm time.Time, member string) int64 {
+	this.expire(key)
+	zset, ok := this.zsets[key]
+	if !ok {
+		zset = make(map[string]time.Time)
+		this.zsets[key] = zset
+	}
+
+	_, exist := zset[member]
+	zset[member] = tm
+	if exist {
+		return 0
+	}
+
+	return 1
+}
+
+func (this *Memory) zrem(key, member string) int64 {
+	this.expire(key)
+	zset, ok := this.zsets[key]
+	if !ok {
+		return 0
+	}
+	if _, ok := zset[member]; !ok {
+		return 0
+	}
+
+	delete(zset, member)
+	if len(zset) == 0 {
+		delete(this.zsets, key)
+	}
+
+	return 1
+}
+
+// 返回score在[min, max]之间的成员，按score和成员排序，min和max为零值时不限制
+func (this *Memory) zrange(key string, min, max time.Time) []string {
+	this.expire(key)
+
+	type item struct {
+		member string
+		tm     time.Time
+	}
+
+	var items []item
+	for member, tm := range this.zsets[key] {
+		if !min.IsZero() && tm.Before(min) {
+			continue
+		}
+		if !max.IsZero() && tm.After(max) {
+			continue
+		}
+		items = append(items, item{member, tm})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].tm.Equal(items[j].tm) {
+			return items[i].tm.Before(items[j].tm)
+		}
+		return items[i].member < items[j].member
+	})
+
+	res := make([]string, 0, len(items))
+	for _, it := range items {
+		res = append(res, it.member)
+	}
+
+	return res
+}
+
+func (this *Memory) sadd(key, member string) int64 {
+	this.expire(key)
+	set, ok := this.sets[key]
+	if !ok {
+		set = make(map[string]bool)
+		this.sets[key] = set
+	}
+
+	if set[member] {
+		return 0
+	}
+
+	set[member] = true
+	return 1
+}
+
+func (this *Memory) sismember(key, member string) bool {
+	this.expire(key)
+	return this.sets[key][member]
+}
+
+func userKey(userid int64) string {
+	return fmt.Sprint(userid)
+}
+
+func (this *Memory) NewMsgID(key string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.counters[key]++
+	return this.counters[key], nil
+}
+
+func (this *Memory) MarkRequest(key, value string, ttl int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.del(key)
+	this.strings[key] = value
+	this.setExpire(key, time.Second*time.Duration(ttl))
+	return nil
+}
+
+func (this *Memory) GetRequest(key string) (string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.expire(key)
+	return this.strings[key], nil
+}
+
+func (this *Memory) ClaimRequest(key, msgid string, lease time.Duration) (*RequestClaim, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.expire(key)
+	if done, ok := this.strings[key]; ok {
+		return &RequestClaim{State: RequestComplete, MsgID: done}, nil
+	}
+
+	claim := key + ":claim"
+	this.expire(claim)
+	if owner, ok := this.strings[claim]; ok && owner != msgid {
+		return &RequestClaim{State: RequestPending, MsgID: owner}, nil
+	}
+
+	this.strings[claim] = msgid
+	this.setExpire(claim, lease)
+	return &RequestClaim{State: RequestClaimed, MsgID: msgid}, nil
+}
+
+func (this *Memory) CompleteRequest(key, msgid string, ttl int) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	claim := key + ":claim"
+	this.expire(claim)
+	if owner, ok := this.strings[claim]; ok && owner != msgid {
+		return false, nil
+	}
+
+	this.expire(key)
+	if _, ok := this.strings[key]; ok {
+		return false, nil
+	}
+
+	this.del(claim)
+	this.strings[key] = msgid
+	this.setExpire(key, time.Second*time.Duration(ttl))
+	return true, nil
+}
+
+func (this *Memory) ReleaseRequest(key, msgid string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	claim := key + ":claim"
+	this.expire(claim)
+	if this.strings[claim] == msgid {
+		this.del(claim)
+	}
+
+	return nil
+}
+
+func (this *Memory) PublishNewMsg(queue string, msg []byte) (int64, error) {
+	if len(queue) == 0 || len(msg) == 0 {
+		return 0, nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.lists[queue] = append(this.lists[queue], msg)
+	return int64(len(this.lists[queue])), nil
+}
+
+func (this *Memory) GetPublishMsg(queue string) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	list := this.lists[queue]
+	if len(list) == 0 {
+		return nil, ErrQueueEmpty
+	}
+
+	this.lists[queue] = list[1:]
+	return list[0], nil
+}
+
+func (this *Memory) NewLazyMsg(set string, tm time.Time, msgid string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.track(msgid, set, targetLazy, time.Until(tm)+recall_TTL*time.Second)
+	return this.zadd(set, tm, msgid), nil
+}
+
+func (this *Memory) GetLazyMsg(set string) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.zrange(set, time.Time{}, time.Now()), nil
+}
+
+func (this *Memory) ClaimLazyMsg(set string, count int) ([]string, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	msgids := this.zrange(set, time.Time{}, time.Now())
+	if len(msgids) > count {
+		msgids = msgids[:count]
+	}
+	for _, msgid := range msgids {
+		this.zrem(set, msgid)
+	}
+
+	return msgids, nil
+}
+
+func (this *Memory) RescheduleLazyMsg(set, msgid string, tm time.Time) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.expire(set)
+	if _, ok := this.zsets[set][msgid]; !ok {
+		return false, nil
+	}
+
+	this.zsets[set][msgid] = tm
+	return true, nil
+}
+
+func (this *Memory) CancelLazyMsg(set, msgid string) (int64, error) {
+	return this.DeleteMsg(set, msgid)
+}
+
+func (this *Memory) NewGroupMsg(key, msgid string, ttl int) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// 标记集合的生存周期为消息周期的2倍
+	this.sadd(msgid, "0")
+	this.setExpire(msgid, 2*time.Second*time.Duration(ttl))
+
+	this.registry[key] = true
+	this.track(msgid, key, targetGroup, 2*time.Second*time.Duration(ttl))
+	return this.zadd(key, time.Now().Add(time.Second*time.Duration(ttl)), msgid), nil
+}
+
+func (this *Memory) MarkGroupMsg(reject bool, userid int64, userFlag, msgid string) (_ int64, err error) {
+	if userid > 0 {
+		defer func() {
+			if _, e := this.MarkUserMsg(reject, userid, msgid); err == nil {
+				err = e
+			}
+		}()
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.ttl(msgid) <= 0 {
+		return 0, ErrExpired
+	}
+
+	return this.sadd(msgid, userFlag), nil
+}
+
+func (this *Memory) GetGroupMsg(key, userFlag string) ([]string, error) {
+	if len(userFlag) == 0 {
+		return nil, nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var ret []string
+	for _, msgid := range this.zrange(key, time.Now(), time.Time{}) {
+		if !this.sismember(msgid, userFlag) {
+			ret = append(ret, msgid)
+		}
+	}
+
+	return ret, nil
+}
+
+func (this *Memory) JoinGroup(key string, userFlags ...string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var n int64
+	for _, userFlag := range userFlags {
+		n += this.sadd(key_MEMBERS+key, userFlag)
+	}
+
+	return n, nil
+}
+
+func (this *Memory) LeaveGroup(key string, userFlags ...string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var n int64
+	members := this.sets[key_MEMBERS+key]
+	for _, userFlag := range userFlags {
+		if members[userFlag] {
+			delete(members, userFlag)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (this *Memory) GetGroupMembers(key string) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var members []string
+	for userFlag := range this.sets[key_MEMBERS+key] {
+		members = append(members, userFlag)
+	}
+
+	return members, nil
+}
+
+func (this *Memory) CountGroupMembers(key string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return int64(len(this.sets[key_MEMBERS+key])), nil
+}
+
+func (this *Memory) IsGroupMember(key, userFlag string) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.sismember(key_MEMBERS+key, userFlag), nil
+}
+
+func (this *Memory) GetMemberGroupMsg(key, userFlag string) ([]string, error) {
+	ok, _ := this.IsGroupMember(key, userFlag)
+	if !ok {
+		return nil, ErrNotMember
+	}
+
+	return this.GetGroupMsg(key, userFlag)
+}
+
+func (this *Memory) GetGroupCoverage(key, msgid string) (*GroupCoverage, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	c := new(GroupCoverage)
+	for userFlag := range this.sets[key_MEMBERS+key] {
+		c.Members++
+		if this.sismember(msgid, userFlag) {
+			c.Delivered++
+		}
+	}
+
+	return c, nil
+}
+
+func (this *Memory) GetUndeliveredMembers(key, msgid string) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var members []string
+	for userFlag := range this.sets[key_MEMBERS+key] {
+		if !this.sismember(msgid, userFlag) {
+			members = append(members, userFlag)
+		}
+	}
+
+	return members, nil
+}
+
+func (this *Memory) DeleteMsg(key, msgid string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.zrem(key, msgid), nil
+}
+
+func (this *Memory) DeleteGroupMsg(key, msgid string) (int64, error) {
+	return this.DeleteMsg(key, msgid)
+}
+
+func (this *Memory) DeleteDeviceMsg(devicekey, msgid string) (int64, error) {
+	return this.DeleteMsg(devicekey, msgid)
+}
+
+func (this *Memory) DeleteUserMsg(userid int64, msgid string) (int64, error) {
+	return this.DeleteMsg(userKey(userid), msgid)
+}
+
+func (this *Memory) IsGroupMsgExist(key, msgid string) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.expire(key)
+	_, ok := this.zsets[key][msgid]
+	return ok, nil
+}
+
+func (this *Memory) NewDeviceMsg(devicekey string, ttl int, msgid string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.registry[devicekey] = true
+	this.track(msgid, devicekey, targetDevice, 2*time.Second*time.Duration(ttl))
+	return this.zadd(devicekey, time.Now().Add(time.Second*time.Duration(ttl)), msgid), nil
+}
+
+func (this *Memory) MarkDeviceMsg(devicekey, msgid string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	n := this.zrem(devicekey, msgid)
+	if n > 0 && this.recall {
+		targets := key_TARGETS + msgid
+		if this.sismember(targets, targetDevice+":"+devicekey) {
+			delete(this.sets[targets], targetDevice+":"+devicekey)
+			this.sadd(targets, targetDelivered+":"+devicekey)
+		}
+	}
+
+	return n, nil
+}
+
+func (this *Memory) GetDeviceMsg(devicekey string) ([]string, error) {
+	if len(devicekey) == 0 {
+		return nil, nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.zrange(devicekey, time.Now(), time.Time{}), nil
+}
+
+func (this *Memory) BindDevice(userid int64, devicekey string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.zadd(key_DEVICES+userKey(userid), time.Now(), devicekey), nil
+}
+
+func (this *Memory) UnbindDevice(userid int64, devicekey string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.zrem(key_DEVICES+userKey(userid), devicekey), nil
+}
+
+func (this *Memory) TouchDevice(userid int64, devicekey string) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	key := key_DEVICES + userKey(userid)
+	this.expire(key)
+	if _, ok := this.zsets[key][devicekey]; !ok {
+		return false, nil
+	}
+
+	this.zadd(key, time.Now(), devicekey)
+	return true, nil
+}
+
+func (this *Memory) GetUserDevices(userid int64, activeWithin time.Duration) ([]*UserDevice, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.userDevices(userid, activeWithin), nil
+}
+
+func (this *Memory) userDevices(userid int64, activeWithin time.Duration) []*UserDevice {
+	var min time.Time
+	if activeWithin > 0 {
+		min = time.Now().Add(-activeWithin)
+	}
+
+	key := key_DEVICES + userKey(userid)
+	var devices []*UserDevice
+	for _, devicekey := range this.zrange(key, min, time.Time{}) {
+		devices = append(devices, &UserDevice{DeviceKey: devicekey, LastSeen: this.zsets[key][devicekey]})
+	}
+
+	return devices
+}
+
+func (this *Memory) SendToUser(userid int64, ttl int, msgid string, activeWithin time.Duration) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	end := time.Now().Add(time.Second * time.Duration(ttl))
+	fanout := key_FANOUT + userKey(userid) + "-" + msgid
+	var devices []string
+	for _, d := range this.userDevices(userid, activeWithin) {
+		this.registry[d.DeviceKey] = true
+		this.zadd(d.DeviceKey, end, msgid)
+		this.track(msgid, d.DeviceKey, targetDevice, 2*time.Second*time.Duration(ttl))
+		if _, ok := this.zsets[fanout][d.DeviceKey]; !ok {
+			this.zadd(fanout, time.Time{}, d.DeviceKey)
+		}
+		devices = append(devices, d.DeviceKey)
+	}
+
+	if len(devices) > 0 {
+		this.setExpire(fanout, 2*time.Second*time.Duration(ttl))
+	}
+
+	return devices, nil
+}
+
+func (this *Memory) MarkUserDeviceMsg(userid int64, devicekey, msgid string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	fanout := key_FANOUT + userKey(userid) + "-" + msgid
+	this.expire(fanout)
+	if tm, ok := this.zsets[fanout][devicekey]; ok && tm.IsZero() {
+		this.zsets[fanout][devicekey] = time.Now()
+	}
+
+	return this.zrem(devicekey, msgid), nil
+}
+
+func (this *Memory) GetFanoutState(userid int64, msgid string) (*FanoutState, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	fanout := key_FANOUT + userKey(userid) + "-" + msgid
+	this.expire(fanout)
+	state := &FanoutState{Delivered: make(map[string]time.Time)}
+	for devicekey, tm := range this.zsets[fanout] {
+		if tm.IsZero() {
+			state.Pending = append(state.Pending, devicekey)
+		} else {
+			state.Delivered[devicekey] = tm
+		}
+	}
+
+	return state, nil
+}
+
+func (this *Memory) IsDeliveredToAny(userid int64, msgid string) (bool, error) {
+	state, err := this.GetFanoutState(userid, msgid)
+	if err != nil {
+		return false, err
+	}
+
+	return state.Any(), nil
+}
+
+func (this *Memory) NewUserMsg(userid int64, ttl int, msgid string) (int64, error) {
+	if userid == 0 {
+		return 0, nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	key := userKey(userid)
+	this.registry[key] = true
+	this.track(msgid, key, targetUser, 2*time.Second*time.Duration(ttl))
+	return this.zadd(key, time.Now().Add(time.Second*time.Duration(ttl)), msgid), nil
+}
+
+func (this *Memory) MarkUserMsg(reject bool, userid int64, msgid string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	history := fmt.Sprintf("%v_pushed", userid)
+	if reject {
+		history = fmt.Sprintf("%v_rejected", userid)
+	}
+	this.registry[history] = true
+	this.zadd(history, time.Now(), msgid)
+	this.trimHistory(history)
+
+	return this.zrem(userKey(userid), msgid), nil
+}
+
+func (this *Memory) GetPushedUserMsg(userid int64) (send []string, rej []string, out []string, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	send = this.zrange(fmt.Sprintf("%v_pushed", userid), time.Time{}, time.Time{})
+	rej = this.zrange(fmt.Sprintf("%v_rejected", userid), time.Time{}, time.Time{})
+	out = this.zrange(userKey(userid), time.Time{}, time.Now())
+	return
+}
+
+func (this *Memory) SetHistoryRetention(r HistoryRetention) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.retention = r
+}
+
+// 按保留策略淘汰历史，调用方需持有锁
+func (this *Memory) trimHistory(history string) {
+	r := this.retention
+	if r.MaxAge > 0 {
+		cutoff := time.Now().Add(-r.MaxAge)
+		for member, tm := range this.zsets[history] {
+			if tm.Before(cutoff) {
+				this.zrem(history, member)
+			}
+		}
+		this.setExpire(history, r.MaxAge+time.Second)
+	}
+
+	if r.MaxCount > 0 {
+		members := this.zrange(history, time.Time{}, time.Time{})
+		for i := int64(0); i < int64(len(members))-r.MaxCount; i++ {
+			this.zrem(history, members[i])
+		}
+	}
+}
+
+func (this *Memory) GetUserHistory(userid int64, q HistoryQuery) ([]*HistoryItem, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	outEnd := q.End
+	if q.End.IsZero() || q.End.After(now) {
+		outEnd = now
+	}
+
+	var items []*HistoryItem
+	collect := func(key, state string, end time.Time) {
+		for _, msgid := range this.zrange(key, q.Start, end) {
+			tm := this.zsets[key][msgid]
+			if state == HistoryExpired && !tm.Before(now) {
+				continue
+			}
+			items = append(items, &HistoryItem{MsgID: msgid, State: state, Time: tm})
+		}
+	}
+
+	collect(fmt.Sprintf("%v_pushed", userid), HistoryPushed, q.End)
+	collect(fmt.Sprintf("%v_rejected", userid), HistoryRejected, q.End)
+	collect(userKey(userid), HistoryExpired, outEnd)
+	return pageHistory(items, q), nil
+}
+
+func (this *Memory) GetUserMsg(userid int64) ([]string, error) {
+	if userid == 0 {
+		return nil, nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.zrange(userKey(userid), time.Now(), time.Time{}), nil
+}
+
+func (this *Memory) CountUnread(userid int64, devicekey, userFlag string, groups ...string) (*UnreadCount, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	c := &UnreadCount{Groups: make(map[string]int64, len(groups))}
+	if userid != 0 {
+		c.User = int64(len(this.zrange(userKey(userid), now, time.Time{})))
+	}
+	if len(devicekey) > 0 {
+		c.Device = int64(len(this.zrange(devicekey, now, time.Time{})))
+	}
+	if len(userFlag) == 0 {
+		return c, nil
+	}
+
+	for _, group := range groups {
+		var n int64
+		for _, msgid := range this.zrange(group, now, time.Time{}) {
+			if !this.sismember(msgid, userFlag) {
+				n++
+			}
+		}
+		c.Groups[group] = n
+		c.Group += n
+	}
+
+	return c, nil
+}
+
+func (this *Memory) GetAckedMsg(hashtable string) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var keys []string
+	for msgid := range this.hashes[hashtable] {
+		keys = append(keys, msgid)
+	}
+
+	return keys, nil
+}
+
+func (this *Memory) AddMsgAck(hashtable, msgid string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	hash, ok := this.hashes[hashtable]
+	if !ok {
+		hash = make(map[string]int64)
+		this.hashes[hashtable] = hash
+	}
+
+	hash[msgid]++
+	return hash[msgid], nil
+}
+
+func (this *Memory) GetMsgAck(hashtable, msgid string) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.hashes[hashtable][msgid], nil
+}
+
+func (this *Memory) ResetMsgAck(hashtable, msgid string, count int64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	hash := this.hashes[hashtable]
+	if hash[msgid] <= count {
+		delete(hash, msgid)
+	} else {
+		hash[msgid] -= count
+	}
+
+	return nil
+}
+
+func (this *Memory) ClearOutDateMsg(keeptime int) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var count int64
+	deadline := time.Now().Add(-1 * time.Second * time.Duration(keeptime))
+	for key := range this.registry {
+		for _, msgid := range this.zrange(key, time.Time{}, deadline) {
+			count += this.zrem(key, msgid)
+		}
+		if _, ok := this.zsets[key]; !ok {
+			delete(this.registry, key)
+		}
+	}
+
+	return count, nil
+}
+
+func (this *Memory) MarkOfficialMsg(msgid string, ttl int64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	key := key_OFFICIAL + msgid
+	this.del(key)
+	this.strings[key] = msgid
+	this.setExpire(key, time.Second*time.Duration(ttl*10))
+	return nil
+}
+
+func (this *Memory) IsOfficialMsg(msgid string) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	key := key_OFFICIAL + msgid
+	this.expire(key)
+	return this.strings[key] == msgid, nil
+}
+
+func (this *Memory) MarkOfficialDevice(devicekey string) (int64, error) {
+	return this.MarkOfficialDeviceIn(devicekey, nil)
+}
+
+func (this *Memory) MarkOfficialDeviceIn(devicekey string, loc *time.Location) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if ok, _ := this.evalCap(devicekey, CapOfficial, "", true); !ok {
+		return 0, nil
+	}
+
+	set := limitDay(loc, 0).Format(limit_TM_FMT)
+	this.sadd(set, devicekey)
+	this.setExpire(set, 10*24*time.Hour)
+	return 1, nil
+}
+
+func (this *Memory) FullOfficialDevice(devicekey string) (bool, error) {
+	return this.FullOfficialDeviceIn(devicekey, nil)
+}
+
+func (this *Memory) FullOfficialDeviceIn(devicekey string, loc *time.Location) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if ok, _ := this.evalCap(devicekey, CapOfficial, "", false); !ok {
+		return true, nil
+	}
+
+	return fullByDays(this.capRules(CapOfficial), func(offset int) (bool, error) {
+		return this.sismember(limitDay(loc, offset).Format(limit_TM_FMT), devicekey), nil
+	})
+}
+
+func (this *Memory) SetCapPolicy(category string, rules []CapRule) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(rules) == 0 {
+		delete(this.caps, category)
+		return nil
+	}
+
+	if this.caps == nil {
+		this.caps = make(map[string][]CapRule)
+	}
+	this.caps[category] = append([]CapRule(nil), rules...)
+	return nil
+}
+
+func (this *Memory) AcquireCap(subject, category, msgid string) (bool, time.Time, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	ok, next := this.evalCap(subject, category, msgid, true)
+	return ok, next, nil
+}
+
+func (this *Memory) CheckCap(subject, category string) (bool, time.Time, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	ok, next := this.evalCap(subject, category, "", false)
+	return ok, next, nil
+}
+
+// 调用方需持有锁
+func (this *Memory) capRules(category string) []CapRule {
+	if rules, ok := this.caps[category]; ok {
+		return rules
+	}
+	return defaultCapPolicies[category]
+}
+
+// 与capScript相同的滑动窗口，调用方需持有锁
+func (this *Memory) evalCap(subject, category, msgid string, record bool) (bool, time.Time) {
+	now := time.Now()
+	rules := this.capRules(category)
+	if len(rules) == 0 {
+		return true, now
+	}
+
+	key := key_CAP + category + "-" + subject
+	this.expire(key)
+	var times []time.Time
+	for _, tm := range this.zsets[key] {
+		times = append(times, tm)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	allow, longest := now, time.Duration(0)
+	for _, r := range rules {
+		if r.Max <= 0 {
+			return false, time.Time{}
+		}
+
+		var within []time.Time
+		for _, tm := range times {
+			if tm.After(now.Add(-r.Window)) {
+				within = append(within, tm)
+			}
+		}
+		// 窗口内第cnt-max+1早的记录滑出窗口后才能再发送
+		if cnt := int64(len(within)); cnt >= r.Max {
+			if at := within[cnt-r.Max].Add(r.Window); at.After(allow) {
+				allow = at
+			}
+		}
+		if r.Window > longest {
+			longest = r.Window
+		}
+	}
+	if allow.After(now) {
+		return false, allow
+	}
+
+	if record && longest > 0 {
+		if len(msgid) == 0 {
+			msgid = uniqueMember()
+		}
+		this.zadd(key, now, msgid)
+		for member, tm := range this.zsets[key] {
+			if !tm.After(now.Add(-longest)) {
+				delete(this.zsets[key], member)
+			}
+		}
+		this.setExpire(key, longest)
+	}
+
+	return true, now
+}
+
+func (this *Memory) SaveMsg(env *Envelope, ttl int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	saved := *env
+	if saved.Created.IsZero() {
+		saved.Created = time.Now()
+	}
+
+	key := key_ENVELOPE + env.MsgID
+	this.del(key)
+	this.envs[key] = &saved
+	if ttl > 0 {
+		this.setExpire(key, time.Second*time.Duration(ttl))
+	}
+
+	return nil
+}
+
+func (this *Memory) GetMsgs(ids ...string) ([]*Envelope, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var envs []*Envelope
+	for _, id := range ids {
+		key := key_ENVELOPE + id
+		this.expire(key)
+		if this.recalled(id) {
+			continue
+		}
+		if env, ok := this.envs[key]; ok {
+			copied := *env
+			envs = append(envs, &copied)
+		}
+	}
+
+	return envs, nil
+}
+
+func (this *Memory) GetUserEnvelopes(userid int64) ([]*Envelope, error) {
+	ids, _ := this.GetUserMsg(userid)
+	return this.GetMsgs(ids...)
+}
+
+func (this *Memory) GetDeviceEnvelopes(devicekey string) ([]*Envelope, error) {
+	ids, _ := this.GetDeviceMsg(devicekey)
+	return this.GetMsgs(ids...)
+}
+
+func (this *Memory) GetGroupEnvelopes(key, userFlag string) ([]*Envelope, error) {
+	ids, _ := this.GetGroupMsg(key, userFlag)
+	return this.GetMsgs(ids...)
+}
+
+func (this *Memory) EnableRecall() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.recall = true
+}
+
+// 登记消息写入的有序集合，成员为类型:key，生存期只延长不缩短，调用方需持有锁
+func (this *Memory) track(msgid, zset, kind string, ttl time.Duration) {
+	if !this.recall {
+		return
+	}
+
+	targets := key_TARGETS + msgid
+	this.sadd(targets, kind+":"+zset)
+	if tm, ok := this.expires[targets]; !ok || tm.Before(time.Now().Add(ttl)) {
+		this.setExpire(targets, ttl)
+	}
+}
+
+func (this *Memory) recalled(msgid string) bool {
+	key := key_RECALLED + msgid
+	this.expire(key)
+	_, ok := this.strings[key]
+	return ok
+}
+
+func (this *Memory) RecallMsg(msgid string) (*RecallResult, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if !this.recall {
+		return nil, ErrRecallDisabled
+	}
+
+	r := new(RecallResult)
+	if this.recalled(msgid) {
+		return r, nil
+	}
+
+	targets := key_TARGETS + msgid
+	ttl := recall_TTL * time.Second
+	if tm, ok := this.expires[targets]; ok && time.Until(tm) > ttl {
+		ttl = time.Until(tm)
+	}
+
+	this.expire(targets)
+
+	group := false
+	for target := range this.sets[targets] {
+		parts := strings.SplitN(target, ":", 2)
+		r.Removed += this.zrem(parts[1], msgid)
+		switch parts[0] {
+		case targetGroup:
+			group = true
+		case targetDelivered:
+			r.Delivered++
+		case targetUser:
+			// 用户消息集合的key就是userid
+			for _, history := range []string{parts[1] + "_pushed", parts[1] + "_rejected"} {
+				this.expire(history)
+				if _, ok := this.zsets[history][msgid]; ok {
+					r.Delivered++
+					break
+				}
+			}
+		}
+	}
+	this.del(targets)
+
+	if group {
+		this.expire(msgid)
+		for userFlag := range this.sets[msgid] {
+			if userFlag != "0" {
+				r.Delivered++
+			}
+		}
+	}
+
+	key := key_RECALLED + msgid
+	this.strings[key] = "1"
+	this.setExpire(key, ttl)
+
+	return r, nil
+}
+
+func (this *Memory) IsRecalled(msgid string) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.recalled(msgid), nil
+}
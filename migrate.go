@@ -0,0 +1,171 @@
+package MsgStore
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 旧key到新key方案的在线迁移
+// 迁移步骤：UseKeyScheme(新方案, true)开启双读 -> MigrateLegacyKeys复制旧key -> UseKeyScheme(新方案, false)
+// 旧key保留不删除，由其生存周期或运维手工清理
+
+// 复制一个旧key到新key，生存周期保持不变
+// 新key不存在时用DUMP/RESTORE原样复制；已存在时（双读期间写入了新key）ZSET和SET取并集，HASH补充缺少的字段
+// STRING和LIST以新key为准
+// KEYS: 旧key 新key
+// 返回0跳过，1复制，2合并
+var migrateKeyScript = redis.NewScript(2, `
+local t = redis.call('TYPE', KEYS[1]).ok
+if t == 'none' then
+	return 0
+end
+local pttl = redis.call('PTTL', KEYS[1])
+if pttl < 0 then
+	pttl = 0
+end
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	redis.call('RESTORE', KEYS[2], pttl, redis.call('DUMP', KEYS[1]))
+	return 1
+end
+local npttl = redis.call('PTTL', KEYS[2])
+if t == 'zset' then
+	redis.call('ZUNIONSTORE', KEYS[2], 2, KEYS[2], KEYS[1], 'AGGREGATE', 'MAX')
+elseif t == 'set' then
+	redis.call('SUNIONSTORE', KEYS[2], KEYS[2], KEYS[1])
+elseif t == 'hash' then
+	local kv = redis.call('HGETALL', KEYS[1])
+	for i = 1, #kv, 2 do
+		redis.call('HSETNX', KEYS[2], kv[i], kv[i + 1])
+	end
+	return 2
+else
+	return 0
+end
+if npttl > pttl then
+	pttl = npttl
+end
+if pttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], pttl)
+end
+return 2
+`)
+
+// 根据旧key的名字和类型返回新key，ok为false时跳过该key
+type LegacyKeyMapper func(key, typ string) (newKey string, ok bool)
+
+var (
+	legacyUserRegexp    = regexp.MustCompile(`^-?\d+$`)
+	legacyHistoryRegexp = regexp.MustCompile(`^(-?\d+)_(pushed|rejected)$`)
+	legacyLimitRegexp   = regexp.MustCompile(`^Limit-\d{8}$`)
+)
+
+// 把旧key映射到k方案的默认规则
+// 能从名字和类型识别的有：用户消息、_pushed和_rejected历史、每日官方消息限额、官方消息标记、消息信封
+// 群组消息、设备消息、群组标记集合、延时消息、广播队列、请求标记、Ack计数和msgid计数器的旧key
+// 只是业务方自定义的名字，无法区分，交给fallback处理，fallback为nil时跳过
+func (k KeyScheme) LegacyMapper(fallback LegacyKeyMapper) LegacyKeyMapper {
+	return func(key, typ string) (string, bool) {
+		switch {
+		case key == key_ZSET_REGISTRY:
+			// 登记集合中是旧key的名字，新方案的登记集合由写入和RegisterZSets重建
+			return "", false
+
+		case !k.legacy() && strings.HasPrefix(key, k.Prefix+":"):
+			return "", false
+
+		case typ == "zset" && legacyUserRegexp.MatchString(key):
+			userid, err := strconv.ParseInt(key, 10, 64)
+			return k.User(userid), err == nil
+
+		case typ == "zset" && legacyHistoryRegexp.MatchString(key):
+			m := legacyHistoryRegexp.FindStringSubmatch(key)
+			userid, err := strconv.ParseInt(m[1], 10, 64)
+			if m[2] == "pushed" {
+				return k.Pushed(userid), err == nil
+			}
+			return k.Rejected(userid), err == nil
+
+		case typ == "set" && legacyLimitRegexp.MatchString(key):
+			// key中只有日期，按UTC解析再格式化得到同一个日期
+			day, err := time.ParseInLocation(limit_TM_FMT, key, time.UTC)
+			return k.Limit(day), err == nil
+
+		case typ == "string" && strings.HasPrefix(key, key_OFFICIAL):
+			return k.Official(strings.TrimPrefix(key, key_OFFICIAL)), true
+
+		case typ == "hash" && strings.HasPrefix(key, key_ENVELOPE):
+			return k.Envelope(strings.TrimPrefix(key, key_ENVELOPE)), true
+		}
+
+		if fallback != nil {
+			return fallback(key, typ)
+		}
+		return "", false
+	}
+}
+
+// 迁移进度
+type MigrateStats struct {
+	Scanned int64 // 扫描过的key数量
+	Copied  int64 // 新key不存在，原样复制的数量
+	Merged  int64 // 新key已存在，合并的数量
+	Skipped int64 // 无法识别或无需迁移的数量
+}
+
+// 用SCAN遍历匹配match的旧key，按mapper复制到新key方案，可以重复执行
+// 返回时的统计包含出错之前已完成的部分
+func (this *Redis) MigrateLegacyKeys(match string, mapper LegacyKeyMapper) (_ MigrateStats, err error) {
+	defer this.guard("MigrateLegacyKeys", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	var stats MigrateStats
+	cursor := int64(0)
+	for {
+		res, err := redis.Values(rc.Do("SCAN", cursor, "MATCH", match, "COUNT", 1000))
+		if err != nil {
+			return stats, err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(res, &cursor, &keys); err != nil {
+			return stats, err
+		}
+
+		for _, key := range keys {
+			stats.Scanned++
+			typ, err := redis.String(rc.Do("TYPE", key))
+			if err != nil {
+				return stats, err
+			}
+
+			newKey, ok := mapper(key, typ)
+			if !ok || newKey == key {
+				stats.Skipped++
+				continue
+			}
+
+			c, err := redis.Int64(migrateKeyScript.Do(rc, key, newKey))
+			if err != nil {
+				return stats, err
+			}
+
+			switch c {
+			case 1:
+				stats.Copied++
+			case 2:
+				stats.Merged++
+			default:
+				stats.Skipped++
+			}
+		}
+
+		if cursor == 0 {
+			return stats, nil
+		}
+	}
+}
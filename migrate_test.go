@@ -0,0 +1,46 @@
+package MsgStore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLegacyMapper(t *testing.T) {
+	k := KeyScheme{Prefix: "msg"}
+	mapper := k.LegacyMapper(nil)
+
+	cases := []struct {
+		key, typ string
+		want     string
+		ok       bool
+	}{
+		{"12345", "zset", k.User(12345), true},
+		{"-7", "zset", k.User(-7), true},
+		{"12345_pushed", "zset", k.Pushed(12345), true},
+		{"12345_rejected", "zset", k.Rejected(12345), true},
+		{"Limit-20240305", "set", k.Limit(time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)), true},
+		{key_OFFICIAL + "m-1", "string", k.Official("m-1"), true},
+		{key_ENVELOPE + "m-1", "hash", k.Envelope("m-1"), true},
+		{key_ZSET_REGISTRY, "set", "", false},
+		{"msg:user:12345", "zset", "", false},
+		{"12345", "hash", "", false},
+		{"custom-group", "zset", "", false},
+	}
+
+	for _, c := range cases {
+		got, ok := mapper(c.key, c.typ)
+		if got != c.want || ok != c.ok {
+			t.Errorf("%s (%s): got %q %v, want %q %v", c.key, c.typ, got, ok, c.want, c.ok)
+		}
+	}
+
+	fallback := k.LegacyMapper(func(key, typ string) (string, bool) {
+		return k.Group(key), typ == "zset"
+	})
+	if got, ok := fallback("custom-group", "zset"); got != k.Group("custom-group") || !ok {
+		t.Errorf("fallback: got %q %v", got, ok)
+	}
+	if got, ok := fallback("12345", "zset"); got != k.User(12345) || !ok {
+		t.Errorf("fallback should not override known keys: got %q %v", got, ok)
+	}
+}
@@ -0,0 +1,340 @@
+package MsgStore
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 用户和设备消息的实时通知
+// NewUserMsg、NewDeviceMsg存储消息后向用户或设备的频道PUBLISH消息ID，在线的网关订阅后不再需要轮询
+// 通知不保证送达，网关上线或重连后仍然要用GetUserMsg、GetDeviceMsg取一次未发送的消息
+
+const key_NOTIFY = "Notify-"
+
+const (
+	NotifyUser   = "user"
+	NotifyDevice = "device"
+)
+
+// 用户消息的通知频道
+func (k KeyScheme) UserChannel(userid int64) string {
+	if k.legacy() {
+		return key_NOTIFY + NotifyUser + "-" + userKey(userid)
+	}
+	return k.join("notify:user", userid)
+}
+
+// 设备消息的通知频道
+func (k KeyScheme) DeviceChannel(devicekey string) string {
+	if k.legacy() {
+		return key_NOTIFY + NotifyDevice + "-" + devicekey
+	}
+	return k.join("notify:device", devicekey)
+}
+
+// 向频道PUBLISH消息ID，消息已经存储，失败时只回调ErrorHook，不返回给调用方，以免调用方重试造成重复发送
+func (this *Redis) notify(rc redis.Conn, channel, msgid string) {
+	if _, err := rc.Do("PUBLISH", channel, msgid); err != nil {
+		this.report("Notify", err)
+	}
+}
+
+// 每个SUBSCRIBE命令最多携带的频道数量
+const notify_SUBSCRIBE_BATCH = 1000
+
+// 收到的通知，Kind为NotifyUser或NotifyDevice，ID为用户ID或设备key
+type Notification struct {
+	Kind  string
+	ID    string
+	MsgID string
+}
+
+// 处理通知的回调，同一个连接上的通知按顺序回调，不同连接的回调是并发的
+type NotifyHandler func(n Notification)
+
+// 订阅参数，零值字段使用默认值
+type NotifyOption struct {
+	Conns        int           // 订阅连接数量，频道按哈希分配到连接上
+	PingInterval time.Duration // 心跳间隔，3个间隔内没有收到任何回复时重连，需小于连接的读超时
+	MinBackoff   time.Duration // 重连的初始间隔
+	MaxBackoff   time.Duration // 重连的最大间隔
+}
+
+var defaultNotifyOption = NotifyOption{
+	Conns:        4,
+	PingInterval: 10 * time.Second,
+	MinBackoff:   100 * time.Millisecond,
+	MaxBackoff:   10 * time.Second,
+}
+
+func (opt *NotifyOption) fill() NotifyOption {
+	res := defaultNotifyOption
+	if opt == nil {
+		return res
+	}
+
+	if opt.Conns > 0 {
+		res.Conns = opt.Conns
+	}
+	if opt.PingInterval > 0 {
+		res.PingInterval = opt.PingInterval
+	}
+	if opt.MinBackoff > 0 {
+		res.MinBackoff = opt.MinBackoff
+	}
+	if opt.MaxBackoff >= res.MinBackoff {
+		res.MaxBackoff = opt.MaxBackoff
+	}
+
+	return res
+}
+
+// 在少量连接上复用大量用户和设备的订阅，连接断开后自动重连并恢复全部订阅
+type Subscriber struct {
+	store   *Redis
+	handler NotifyHandler
+	opt     NotifyOption
+	shards  []*notifyShard
+}
+
+// 一个订阅连接和分配到它上面的频道
+type notifyShard struct {
+	mu      sync.Mutex
+	targets map[string]Notification // 频道到订阅目标
+	conn    *redis.PubSubConn       // 当前连接，未连接时为nil
+}
+
+// 订阅连接不从连接池借用，直接用连接池的Dial建立，不占用MaxActive
+func (this *Redis) NewSubscriber(handler NotifyHandler, opt *NotifyOption) *Subscriber {
+	o := opt.fill()
+	shards := make([]*notifyShard, o.Conns)
+	for i := range shards {
+		shards[i] = &notifyShard{targets: make(map[string]Notification)}
+	}
+
+	return &Subscriber{store: this, handler: handler, opt: o, shards: shards}
+}
+
+func (this *Subscriber) shard(channel string) *notifyShard {
+	h := fnv.New32a()
+	h.Write([]byte(channel))
+	return this.shards[h.Sum32()%uint32(len(this.shards))]
+}
+
+// 订阅用户消息通知，Run之前订阅的在连接建立时生效
+func (this *Subscriber) SubscribeUser(userid int64) {
+	this.subscribe(this.store.Keys().UserChannel(userid), Notification{Kind: NotifyUser, ID: userKey(userid)})
+}
+
+// 订阅设备消息通知
+func (this *Subscriber) SubscribeDevice(devicekey string) {
+	this.subscribe(this.store.Keys().DeviceChannel(devicekey), Notification{Kind: NotifyDevice, ID: devicekey})
+}
+
+func (this *Subscriber) UnsubscribeUser(userid int64) {
+	this.unsubscribe(this.store.Keys().UserChannel(userid))
+}
+
+func (this *Subscriber) UnsubscribeDevice(devicekey string) {
+	this.unsubscribe(this.store.Keys().DeviceChannel(devicekey))
+}
+
+// 写入失败说明连接已断开，重连时会恢复订阅，不需要处理
+func (this *Subscriber) subscribe(channel string, target Notification) {
+	s := this.shard(channel)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.targets[channel]; ok {
+		return
+	}
+
+	s.targets[channel] = target
+	if s.conn != nil {
+		s.conn.Subscribe(channel)
+	}
+}
+
+func (this *Subscriber) unsubscribe(channel string) {
+	s := this.shard(channel)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.targets[channel]; !ok {
+		return
+	}
+
+	delete(s.targets, channel)
+	if s.conn != nil {
+		s.conn.Unsubscribe(channel)
+	}
+}
+
+// 当前订阅的频道数量
+func (this *Subscriber) Count() int {
+	n := 0
+	for _, s := range this.shards {
+		s.mu.Lock()
+		n += len(s.targets)
+		s.mu.Unlock()
+	}
+
+	return n
+}
+
+// 建立订阅连接并接收通知，直到ctx被取消才返回
+func (this *Subscriber) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range this.shards {
+		wg.Add(1)
+		go func(s *notifyShard) {
+			defer wg.Done()
+			this.shardLoop(ctx, s)
+		}(s)
+	}
+
+	wg.Wait()
+}
+
+func (this *Subscriber) shardLoop(ctx context.Context, s *notifyShard) {
+	backoff := this.opt.MinBackoff
+	for ctx.Err() == nil {
+		start := time.Now()
+		if err := this.serve(ctx, s); err == nil {
+			return
+		}
+
+		// 连接稳定运行过一段时间后断开的，从初始间隔开始重连
+		if time.Since(start) > this.opt.MaxBackoff {
+			backoff = this.opt.MinBackoff
+		}
+		if !sleepContext(ctx, backoff) {
+			return
+		}
+		if backoff *= 2; backoff > this.opt.MaxBackoff {
+			backoff = this.opt.MaxBackoff
+		}
+	}
+}
+
+// 在一个连接上订阅并接收，ctx被取消时返回nil，连接出错时返回错误
+func (this *Subscriber) serve(ctx context.Context, s *notifyShard) (err error) {
+	defer this.store.guard("Subscriber", &err)
+	c, err := this.store.pool.Dial()
+	if err != nil {
+		return err
+	}
+
+	psc := &redis.PubSubConn{Conn: c}
+	defer psc.Close()
+
+	if err := s.attach(psc); err != nil {
+		return err
+	}
+	defer s.detach()
+
+	// 心跳协程在ctx取消或心跳超时时关闭连接，使Receive返回
+	alive := time.Now().UnixNano()
+	done := make(chan struct{})
+	defer close(done)
+	go this.keepalive(ctx, s, psc, &alive, done)
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			atomic.StoreInt64(&alive, time.Now().UnixNano())
+			if n, ok := s.target(v.Channel); ok {
+				n.MsgID = string(v.Data)
+				this.dispatch(n)
+			}
+
+		case redis.Subscription, redis.Pong:
+			atomic.StoreInt64(&alive, time.Now().UnixNano())
+
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return v
+		}
+	}
+}
+
+func (this *Subscriber) keepalive(ctx context.Context, s *notifyShard, psc *redis.PubSubConn, alive *int64, done chan struct{}) {
+	t := time.NewTicker(this.opt.PingInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			psc.Conn.Close()
+			return
+		case <-t.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(alive))) > 3*this.opt.PingInterval {
+				psc.Conn.Close()
+				return
+			}
+
+			s.mu.Lock()
+			psc.Ping("")
+			s.mu.Unlock()
+		}
+	}
+}
+
+// 隔离回调中的panic，panic通过ErrorHook报告
+func (this *Subscriber) dispatch(n Notification) {
+	var err error
+	defer this.store.guard("NotifyHandler", &err)
+	this.handler(n)
+}
+
+// 在新连接上恢复全部订阅，之后的订阅变化直接写入这个连接
+func (this *notifyShard) attach(psc *redis.PubSubConn) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	channels := make([]interface{}, 0, notify_SUBSCRIBE_BATCH)
+	for channel := range this.targets {
+		channels = append(channels, channel)
+		if len(channels) == notify_SUBSCRIBE_BATCH {
+			if err := psc.Subscribe(channels...); err != nil {
+				return err
+			}
+			channels = channels[:0]
+		}
+	}
+
+	// 没有订阅任何频道时也要进入订阅模式，之后的SUBSCRIBE和PING才能正常回复
+	if len(channels) == 0 {
+		channels = append(channels, key_NOTIFY)
+	}
+	if err := psc.Subscribe(channels...); err != nil {
+		return err
+	}
+
+	this.conn = psc
+	return nil
+}
+
+func (this *notifyShard) detach() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.conn = nil
+}
+
+func (this *notifyShard) target(channel string) (Notification, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	n, ok := this.targets[channel]
+	return n, ok
+}
@@ -0,0 +1,57 @@
+package MsgStore
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestNotifyOnlyNewMsg(t *testing.T) {
+	s, mr := newTestRedis(t)
+
+	c, err := redis.Dial("tcp", mr.Addr(), redis.DialReadTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	psc := redis.PubSubConn{Conn: c}
+	defer psc.Close()
+
+	keys := s.Keys()
+	if err := psc.Subscribe(keys.UserChannel(7), keys.DeviceChannel("dev-7")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := psc.Receive().(redis.Subscription); !ok {
+			t.Fatal("subscription not confirmed")
+		}
+	}
+
+	// 重复写入只更新生命周期，不再通知
+	for _, msgid := range []string{"n-1", "n-1", "n-2"} {
+		if _, err := s.NewUserMsg(7, 60, msgid); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.NewDeviceMsg("dev-7", 60, msgid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for {
+		m, ok := psc.Receive().(redis.Message)
+		if !ok {
+			break
+		}
+		got = append(got, m.Channel+" "+string(m.Data))
+	}
+
+	want := []string{
+		keys.UserChannel(7) + " n-1", keys.DeviceChannel("dev-7") + " n-1",
+		keys.UserChannel(7) + " n-2", keys.DeviceChannel("dev-7") + " n-2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("notifications = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,363 @@
+package MsgStore
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 消息撤回
+// 调用EnableRecall后，消息写入用户、设备、群组或延时消息集合时，在该消息的投递记录HASH中登记有序集合的key和类型
+// RecallMsg按投递记录分批从所有集合中删除消息，并写入撤回标记，已取到msgid的读取方通过撤回标记跳过该消息
+// 未启用时不登记投递记录，待发送集合中的消息无法删除，RecallMsg返回ErrRecallDisabled
+// 已送达的接收方：用户按发送和拒绝历史判断，设备由MarkDeviceMsg在投递记录中改为已送达，群组按标记集合统计
+
+const key_TARGETS = "Targets-"
+const key_RECALLED = "Recalled-"
+
+// 撤回标记至少保留的时长（秒），投递记录的剩余生存期更长时取后者
+const recall_TTL = 7 * 24 * 3600
+
+// 投递记录中有序集合的类型
+const (
+	targetUser   = "user"
+	targetDevice = "device"
+	targetGroup  = "group"
+	targetLazy   = "lazy"
+
+	// MarkDeviceMsg标记过的设备消息集合
+	targetDelivered = "delivered"
+)
+
+// 消息的投递记录
+func (k KeyScheme) Targets(msgid string) string {
+	if k.legacy() {
+		return key_TARGETS + msgid
+	}
+	return k.join("targets", msgid)
+}
+
+// 消息的撤回标记
+func (k KeyScheme) Recalled(msgid string) string {
+	if k.legacy() {
+		return key_RECALLED + msgid
+	}
+	return k.join("recalled", msgid)
+}
+
+// 登记消息写入的有序集合，投递记录的生存期只延长不缩短
+// KEYS: 投递记录
+// ARGV: 生存秒数 有序集合 类型...
+var trackScript = redis.NewScript(1, `
+for i = 2, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+if redis.call('TTL', KEYS[1]) < tonumber(ARGV[1]) then
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// 从一批有序集合中删除消息，返回删除的数量
+// KEYS: 有序集合...
+// ARGV: msgid
+var recallBatchScript = redis.NewScript(-1, `
+local removed = 0
+for i = 1, #KEYS do
+	removed = removed + redis.call('ZREM', KEYS[i], ARGV[1])
+end
+return removed
+`)
+
+// 把投递记录中登记过的设备消息集合改为已送达，没有登记的不处理
+// KEYS: 投递记录...
+// ARGV: 设备消息集合...
+var deliveredScript = redis.NewScript(-1, `
+for _, key in ipairs(KEYS) do
+	for _, zset in ipairs(ARGV) do
+		if redis.call('HGET', key, zset) == 'device' then
+			redis.call('HSET', key, zset, 'delivered')
+		end
+	end
+end
+return 1
+`)
+
+// 每次从投递记录中取出处理的有序集合数量，群发消息的投递记录可能有几十万项
+const recall_BATCH = 500
+
+// 撤回的结果
+type RecallResult struct {
+	Removed   int64 // 从待发送集合中删除的数量
+	Delivered int64 // 撤回前已送达的接收方数量
+}
+
+// 启用投递记录，只有启用之后写入的消息可以从待发送集合中撤回
+// 投递记录每条消息每个接收方多写一项，群发量大时占用较多内存，需要撤回功能时才启用
+func (this *Redis) EnableRecall() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.recall = true
+}
+
+func (this *Redis) recallEnabled() bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.recall
+}
+
+// 登记消息写入的有序集合，ttl为投递记录的生存秒数，未启用时不登记
+func (this *Redis) track(rc redis.Conn, msgid, zset, kind string, ttl int) error {
+	if !this.recallEnabled() {
+		return nil
+	}
+
+	_, err := trackScript.Do(rc, this.Keys().Targets(msgid), ttl, zset, kind)
+	return err
+}
+
+// 在投递记录中记录设备已收到消息，未启用时不记录
+func (this *Redis) trackDelivered(rc redis.Conn, msgid string, zsets []string) error {
+	if !this.recallEnabled() {
+		return nil
+	}
+
+	targets := this.readKeysOf(func(k KeyScheme) string { return k.Targets(msgid) })
+	args := redis.Args{len(targets)}.AddFlat(targets).AddFlat(zsets)
+	_, err := deliveredScript.Do(rc, args...)
+	return err
+}
+
+// 撤回消息，先写入撤回标记，再按投递记录分批从登记过的用户、设备、群组和延时消息集合中删除
+// 过期、删除或被清理的消息不算已送达，用户消息只有在发送或拒绝历史中才算已送达
+// 中途出错时可以重新调用，继续处理剩余的投递记录，已处理完的重复撤回返回的数量都为0
+// 没有调用EnableRecall时返回ErrRecallDisabled，不写入撤回标记
+func (this *Redis) RecallMsg(msgid string) (_ *RecallResult, err error) {
+	defer this.guard("RecallMsg", &err)
+	if !this.recallEnabled() {
+		return nil, ErrRecallDisabled
+	}
+
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	targets := this.readKeysOf(func(k KeyScheme) string { return k.Targets(msgid) })
+	marker := this.Keys().Recalled(msgid)
+
+	// 撤回标记至少保留到投递记录过期，读取方在此之前都可能取到msgid
+	ttl := int64(recall_TTL)
+	for _, key := range append([]string{marker}, targets...) {
+		t, err := redis.Int64(rc.Do("TTL", key))
+		if err != nil {
+			return nil, err
+		}
+		if t > ttl {
+			ttl = t
+		}
+	}
+	if _, err := rc.Do("SET", marker, 1, "EX", ttl); err != nil {
+		return nil, err
+	}
+
+	r := new(RecallResult)
+	seen := make(map[string]bool)
+	users := make(map[int64]bool)
+	group := false
+	for _, key := range targets {
+		for cursor := int64(0); ; {
+			res, err := redis.Values(rc.Do("HSCAN", key, cursor, "COUNT", recall_BATCH))
+			if err != nil {
+				return nil, err
+			}
+			if cursor, err = redis.Int64(res[0], nil); err != nil {
+				return nil, err
+			}
+			items, err := redis.Strings(res[1], nil)
+			if err != nil {
+				return nil, err
+			}
+
+			var zsets redis.Args
+			var userids []int64
+			for i := 0; i+1 < len(items); i += 2 {
+				if seen[items[i]] {
+					continue
+				}
+				seen[items[i]] = true
+				zsets = zsets.Add(items[i])
+
+				switch items[i+1] {
+				case targetGroup:
+					group = true
+				case targetDelivered:
+					r.Delivered++
+				case targetUser:
+					// 迁移期间新旧两个用户消息集合属于同一个用户
+					if userid, ok := this.userOf(items[i]); ok && !users[userid] {
+						users[userid] = true
+						userids = append(userids, userid)
+					}
+				}
+			}
+
+			if len(zsets) > 0 {
+				args := redis.Args{len(zsets)}.AddFlat(zsets).Add(msgid)
+				removed, err := redis.Int64(recallBatchScript.Do(rc, args...))
+				if err != nil {
+					return nil, err
+				}
+				r.Removed += removed
+			}
+
+			delivered, err := this.countPushed(rc, userids, msgid)
+			if err != nil {
+				return nil, err
+			}
+			r.Delivered += delivered
+
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	if group {
+		marks := this.readKeysOf(func(k KeyScheme) string { return k.GroupMark(msgid) })
+		n, err := countMarked(rc, marks)
+		if err != nil {
+			return nil, err
+		}
+		r.Delivered += n
+	}
+
+	// 处理完再删除投递记录，中途出错时重新调用可以继续
+	for _, key := range targets {
+		if _, err := rc.Do("DEL", key); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// 用户消息集合的key对应的用户，不是用户消息集合时返回false
+func (this *Redis) userOf(key string) (int64, bool) {
+	for _, k := range this.readKeys() {
+		id := key
+		if !k.legacy() {
+			prefix := k.join("user", "")
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			id = key[len(prefix):]
+		}
+
+		if userid, err := strconv.ParseInt(id, 10, 64); err == nil {
+			return userid, true
+		}
+	}
+
+	return 0, false
+}
+
+// 统计发送或拒绝历史中有该消息的用户数量
+func (this *Redis) countPushed(rc redis.Conn, userids []int64, msgid string) (int64, error) {
+	if len(userids) == 0 {
+		return 0, nil
+	}
+
+	schemes := this.readKeys()
+	for _, userid := range userids {
+		for _, k := range schemes {
+			rc.Send("ZSCORE", k.Pushed(userid), msgid)
+			rc.Send("ZSCORE", k.Rejected(userid), msgid)
+		}
+	}
+
+	reply, err := rc.Do("")
+	if err := replyErr(reply, err); err != nil {
+		return 0, err
+	}
+
+	// 每个用户依次为各方案的发送和拒绝历史
+	scores, _ := reply.([]interface{})
+	per := 2 * len(schemes)
+	var n int64
+	for i := 0; i+per <= len(scores); i += per {
+		for _, score := range scores[i : i+per] {
+			if score != nil {
+				n++
+				break
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// 统计群组标记集合中已标记的成员数量，"0"是创建时的占位，多个集合中的同一成员只算一次
+func countMarked(rc redis.Conn, marks []string) (int64, error) {
+	if len(marks) == 1 {
+		n, err := redis.Int64(rc.Do("SCARD", marks[0]))
+		if err != nil || n == 0 {
+			return n, err
+		}
+
+		placeholder, err := redis.Bool(rc.Do("SISMEMBER", marks[0], "0"))
+		if err != nil {
+			return 0, err
+		}
+		if placeholder {
+			n--
+		}
+		return n, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range marks {
+		for cursor := int64(0); ; {
+			res, err := redis.Values(rc.Do("SSCAN", key, cursor, "COUNT", recall_BATCH))
+			if err != nil {
+				return 0, err
+			}
+			if cursor, err = redis.Int64(res[0], nil); err != nil {
+				return 0, err
+			}
+			members, err := redis.Strings(res[1], nil)
+			if err != nil {
+				return 0, err
+			}
+
+			for _, m := range members {
+				if m != "0" {
+					seen[m] = true
+				}
+			}
+
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	return int64(len(seen)), nil
+}
+
+// 消息是否已被撤回
+func (this *Redis) IsRecalled(msgid string) (_ bool, err error) {
+	defer this.guard("IsRecalled", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	for _, k := range this.readKeys() {
+		ok, err := redis.Bool(rc.Do("EXISTS", k.Recalled(msgid)))
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+
+	return false, nil
+}
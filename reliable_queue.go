@@ -0,0 +1,188 @@
+package MsgStore
+
+import (
+	"context"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 可靠广播队列，至少投递一次
+// 取出的消息分配ID后放入消费者的在途LIST，并在queue:deadline的ZSET中记录可见性超时时间
+// 消费者处理完后调用AckPublishMsg确认，超时未确认的消息由ReapPublishMsg放回queue:retry重新投递
+// 投递次数达到上限的消息转入死信队列queue:dead
+// queue:seq使用INCR生成在途消息ID
+// queue:payload使用HASH保存ID和消息内容的映射
+// queue:delivery使用HASH保存ID和投递次数的映射
+// queue:owner使用HASH保存ID和消费者的映射
+// queue:inflight:<consumer>使用LIST保存消费者的在途消息ID
+type InflightMsg struct {
+	ID       string
+	Msg      []byte
+	Delivery int64 // 第几次投递，大于1说明曾经超时未确认
+}
+
+// 取消息：优先取待重投的ID，其次从广播队列取新消息
+// KEYS: queue retry seq payload delivery owner deadline inflight
+// ARGV: 超时时间(毫秒) 消费者
+var popReliableScript = redis.NewScript(8, `
+local id = redis.call('LPOP', KEYS[2])
+local msg
+if id then
+	msg = redis.call('HGET', KEYS[4], id)
+else
+	msg = redis.call('LPOP', KEYS[1])
+	if not msg then
+		return false
+	end
+	id = tostring(redis.call('INCR', KEYS[3]))
+	redis.call('HSET', KEYS[4], id, msg)
+end
+local n = redis.call('HINCRBY', KEYS[5], id, 1)
+redis.call('HSET', KEYS[6], id, ARGV[2])
+redis.call('ZADD', KEYS[7], ARGV[1], id)
+redis.call('RPUSH', KEYS[8], id)
+return {id, msg, n}
+`)
+
+// 确认消息，只有消息的当前持有者可以确认
+// KEYS: payload delivery owner deadline inflight
+// ARGV: ID 消费者
+var ackReliableScript = redis.NewScript(5, `
+if redis.call('HGET', KEYS[3], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('LREM', KEYS[5], 1, ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1
+`)
+
+// 回收超时消息，最大投递次数不大于0时不限制
+// 在途LIST的key由队列名和消费者在脚本中拼成，没有在KEYS中声明，只能用于单节点redis，不能用于集群
+// KEYS: retry payload delivery owner deadline dead
+// ARGV: 当前时间(毫秒) 最大投递次数 单次处理上限 队列名
+var reapReliableScript = redis.NewScript(6, `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[5], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[3]))
+local requeued, dead = 0, 0
+local max = tonumber(ARGV[2])
+for _, id in ipairs(ids) do
+	local owner = redis.call('HGET', KEYS[4], id)
+	if owner then
+		redis.call('LREM', ARGV[4] .. ':inflight:' .. owner, 1, id)
+	end
+	redis.call('ZREM', KEYS[5], id)
+	redis.call('HDEL', KEYS[4], id)
+	local n = tonumber(redis.call('HGET', KEYS[3], id) or '0')
+	if max > 0 and n >= max then
+		local msg = redis.call('HGET', KEYS[2], id)
+		if msg then
+			redis.call('RPUSH', KEYS[6], msg)
+		end
+		redis.call('HDEL', KEYS[2], id)
+		redis.call('HDEL', KEYS[3], id)
+		dead = dead + 1
+	else
+		redis.call('RPUSH', KEYS[1], id)
+		requeued = requeued + 1
+	end
+end
+return {requeued, dead}
+`)
+
+const reliable_REAP_BATCH = 100
+
+func inflightKey(queue, consumer string) string {
+	return queue + ":inflight:" + consumer
+}
+
+// 可靠广播队列的死信队列，保存投递次数达到上限的原始消息
+func (k KeyScheme) DeadLetter(queue string) string {
+	return k.Queue(queue) + ":dead"
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// 可靠地取一个消息，非阻塞，队列空时返回nil
+// 消息在visibility时长内必须被确认，否则会被重新投递
+func (this *Redis) PopReliableMsg(queue, consumer string, visibility time.Duration) (_ *InflightMsg, err error) {
+	if len(queue) == 0 || len(consumer) == 0 {
+		return nil, nil
+	}
+
+	defer this.guard("PopReliableMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	q := this.Keys().Queue(queue)
+	deadline := nowMillis() + int64(visibility/time.Millisecond)
+	res, err := redis.Values(popReliableScript.Do(rc,
+		q, q+":retry", q+":seq", q+":payload", q+":delivery",
+		q+":owner", q+":deadline", inflightKey(q, consumer),
+		deadline, consumer))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(InflightMsg)
+	if _, err := redis.Scan(res, &msg.ID, &msg.Msg, &msg.Delivery); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// 确认消息已处理，返回确认成功的数量0|1
+// 消息已超时并被重新分配给其他消费者时返回0
+func (this *Redis) AckPublishMsg(queue, consumer, id string) (_ int64, err error) {
+	defer this.guard("AckPublishMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	q := this.Keys().Queue(queue)
+	return redis.Int64(ackReliableScript.Do(rc,
+		q+":payload", q+":delivery", q+":owner", q+":deadline",
+		inflightKey(q, consumer), id, consumer))
+}
+
+// 把可见性超时的消息放回重投队列，投递次数达到maxDelivery的转入死信队列，maxDelivery不大于0时总是重投
+// 返回重新入队和转入死信的数量
+func (this *Redis) ReapPublishMsg(queue string, maxDelivery int64) (requeued, dead int64, err error) {
+	defer this.guard("ReapPublishMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	keys := this.Keys()
+	q := keys.Queue(queue)
+	res, err := redis.Values(reapReliableScript.Do(rc,
+		q+":retry", q+":payload", q+":delivery", q+":owner",
+		q+":deadline", keys.DeadLetter(queue),
+		nowMillis(), maxDelivery, reliable_REAP_BATCH, q))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, err = redis.Scan(res, &requeued, &dead)
+	return
+}
+
+// 周期性回收超时消息，直到ctx被取消
+// 多个进程同时运行也是安全的，回收操作在服务端原子完成
+func (this *Redis) RunPublishReaper(ctx context.Context, queue string, maxDelivery int64, interval time.Duration) {
+	for sleepContext(ctx, interval) {
+		// 一次最多处理reliable_REAP_BATCH个，积压时连续处理
+		for ctx.Err() == nil {
+			requeued, dead, err := this.ReapPublishMsg(queue, maxDelivery)
+			if err != nil || requeued+dead < reliable_REAP_BATCH {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package MsgStore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestReliableAck(t *testing.T) {
+	s, _ := newTestRedis(t)
+	if _, err := s.PublishNewMsg("rq", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := s.PopReliableMsg("rq", "c1", time.Minute)
+	if err != nil || msg == nil || string(msg.Msg) != "a" || msg.Delivery != 1 {
+		t.Fatalf("PopReliableMsg = %+v, %v", msg, err)
+	}
+
+	// 只有持有者可以确认
+	if n, err := s.AckPublishMsg("rq", "c2", msg.ID); err != nil || n != 0 {
+		t.Errorf("AckPublishMsg by c2 = %d, %v, want 0", n, err)
+	}
+	if n, err := s.AckPublishMsg("rq", "c1", msg.ID); err != nil || n != 1 {
+		t.Errorf("AckPublishMsg by c1 = %d, %v, want 1", n, err)
+	}
+
+	if requeued, dead, err := s.ReapPublishMsg("rq", 0); err != nil || requeued != 0 || dead != 0 {
+		t.Errorf("ReapPublishMsg = %d, %d, %v, want nothing", requeued, dead, err)
+	}
+	if msg, err := s.PopReliableMsg("rq", "c1", time.Minute); err != nil || msg != nil {
+		t.Errorf("PopReliableMsg on empty queue = %+v, %v", msg, err)
+	}
+}
+
+func TestReliableRedeliveryAndDeadLetter(t *testing.T) {
+	s, _ := newTestRedis(t)
+	if _, err := s.PublishNewMsg("rq", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := s.PopReliableMsg("rq", "c1", time.Millisecond)
+	if err != nil || first == nil {
+		t.Fatalf("PopReliableMsg = %+v, %v", first, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// 超时未确认的消息放回重投队列，原持有者不能再确认
+	if requeued, dead, err := s.ReapPublishMsg("rq", 2); err != nil || requeued != 1 || dead != 0 {
+		t.Fatalf("ReapPublishMsg = %d, %d, %v, want 1 requeued", requeued, dead, err)
+	}
+	if n, err := s.AckPublishMsg("rq", "c1", first.ID); err != nil || n != 0 {
+		t.Errorf("AckPublishMsg after reap = %d, %v, want 0", n, err)
+	}
+
+	second, err := s.PopReliableMsg("rq", "c2", time.Millisecond)
+	if err != nil || second == nil || second.ID != first.ID || string(second.Msg) != "b" || second.Delivery != 2 {
+		t.Fatalf("PopReliableMsg again = %+v, %v", second, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// 达到投递上限转入死信队列
+	if requeued, dead, err := s.ReapPublishMsg("rq", 2); err != nil || requeued != 0 || dead != 1 {
+		t.Fatalf("ReapPublishMsg = %d, %d, %v, want 1 dead", requeued, dead, err)
+	}
+
+	rc := s.pool.Get()
+	defer rc.Close()
+	dead, err := redis.Strings(rc.Do("LRANGE", s.Keys().DeadLetter("rq"), 0, -1))
+	if err != nil || len(dead) != 1 || dead[0] != "b" {
+		t.Errorf("dead letters = %v, %v", dead, err)
+	}
+	inflight, err := redis.Int64(rc.Do("LLEN", inflightKey(s.Keys().Queue("rq"), "c2")))
+	if err != nil || inflight != 0 {
+		t.Errorf("inflight of c2 = %d, %v, want 0", inflight, err)
+	}
+}
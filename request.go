@@ -0,0 +1,119 @@
+package MsgStore
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 请求去重，同一个请求哈希值只有一个生产者能创建消息
+// 生产者先ClaimRequest取得请求，创建消息后CompleteRequest记录哈希值和消息ID的映射
+// 取得请求后在lease时长内没有完成的（生产者崩溃），其他生产者可以接管
+type RequestState int
+
+const (
+	RequestClaimed  RequestState = iota // 本次调用取得了请求
+	RequestPending                      // 其他生产者正在处理，lease未到期
+	RequestComplete                     // 请求已完成，MsgID为已创建的消息
+)
+
+type RequestClaim struct {
+	State RequestState
+	MsgID string // 取得请求、正在处理或已完成的消息ID
+}
+
+// 取得请求，已完成时返回已有的映射，正在处理时返回处理者的消息ID
+// KEYS: 映射key... 处理中标记key
+// ARGV: msgid lease(毫秒)
+var claimRequestScript = redis.NewScript(-1, `
+for i = 1, #KEYS - 1 do
+	local done = redis.call('GET', KEYS[i])
+	if done then
+		return {2, done}
+	end
+end
+local claim = KEYS[#KEYS]
+local owner = redis.call('GET', claim)
+if owner and owner ~= ARGV[1] then
+	return {1, owner}
+end
+redis.call('SET', claim, ARGV[1], 'PX', ARGV[2])
+return {0, ARGV[1]}
+`)
+
+// 完成请求，只有当前处理者或lease到期后没有新处理者时才能完成
+// KEYS: 映射key 处理中标记key
+// ARGV: msgid ttl(秒)
+var completeRequestScript = redis.NewScript(2, `
+local owner = redis.call('GET', KEYS[2])
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2], 'NX') then
+	redis.call('DEL', KEYS[2])
+	return 1
+end
+return 0
+`)
+
+// 放弃请求，只删除自己的处理中标记
+// KEYS: 处理中标记key
+// ARGV: msgid
+var releaseRequestScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// 处理中的请求标记
+func (k KeyScheme) RequestClaim(key string) string {
+	return k.Request(key) + ":claim"
+}
+
+// 原子地取得请求，State为RequestClaimed时调用方负责创建消息并CompleteRequest
+// 同一个msgid重复调用会续租lease
+func (this *Redis) ClaimRequest(key, msgid string, lease time.Duration) (_ *RequestClaim, err error) {
+	defer this.guard("ClaimRequest", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.Request(key) })
+	args := redis.Args{len(keys) + 1}.AddFlat(keys).Add(this.Keys().RequestClaim(key))
+	args = args.Add(msgid, int64(lease/time.Millisecond))
+	res, err := redis.Values(claimRequestScript.Do(rc, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	var state int
+	claim := new(RequestClaim)
+	if _, err := redis.Scan(res, &state, &claim.MsgID); err != nil {
+		return nil, err
+	}
+
+	claim.State = RequestState(state)
+	return claim, nil
+}
+
+// 完成请求，记录哈希值和消息ID的映射ttl秒，返回是否成功
+// 返回false说明lease已到期并被其他生产者接管，或请求已被完成
+func (this *Redis) CompleteRequest(key, msgid string, ttl int) (_ bool, err error) {
+	defer this.guard("CompleteRequest", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	keys := this.Keys()
+	c, err := redis.Int64(completeRequestScript.Do(rc, keys.Request(key), keys.RequestClaim(key), msgid, ttl))
+	return c > 0, err
+}
+
+// 放弃取得的请求，其他生产者可以立即接管
+func (this *Redis) ReleaseRequest(key, msgid string) (err error) {
+	defer this.guard("ReleaseRequest", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	_, err = releaseRequestScript.Do(rc, this.Keys().RequestClaim(key), msgid)
+	return err
+}
@@ -0,0 +1,196 @@
+package MsgStore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 延时消息调度，原子地取出并删除到期的延时消息，多个进程同时调度也不会重复派发
+// 取出到期消息，最多count个
+// KEYS: set
+// ARGV: 数量 区间数量 min max...
+var claimLazyScript = redis.NewScript(1, `
+local ret, left = {}, tonumber(ARGV[1])
+for j = 1, tonumber(ARGV[2]) do
+	if left <= 0 then
+		break
+	end
+	local ids = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[2 * j + 1], ARGV[2 * j + 2], 'LIMIT', 0, left)
+	if #ids > 0 then
+		redis.call('ZREM', KEYS[1], unpack(ids))
+		for _, id in ipairs(ids) do
+			ret[#ret + 1] = id
+		end
+		left = left - #ids
+	end
+end
+return ret
+`)
+
+// 派发延时消息的回调，返回错误时消息会在重试间隔后重新调度
+type LazyDispatcher func(set, msgid string) error
+
+type Scheduler struct {
+	store *Redis
+
+	Batch      int           // 单次取出的最大消息数量
+	Interval   time.Duration // 没有到期消息时的轮询间隔
+	RetryDelay time.Duration // 派发失败后的重试间隔
+
+	mu       sync.RWMutex
+	handlers map[string]LazyDispatcher
+}
+
+func (this *Redis) NewScheduler() *Scheduler {
+	return &Scheduler{
+		store:      this,
+		Batch:      100,
+		Interval:   time.Second,
+		RetryDelay: time.Minute,
+		handlers:   make(map[string]LazyDispatcher),
+	}
+}
+
+// 为延时消息集合注册派发回调，重复注册会覆盖之前的回调
+func (this *Scheduler) Handle(set string, dispatch LazyDispatcher) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.handlers[set] = dispatch
+}
+
+// 轮询所有注册过的集合并派发到期消息，直到ctx被取消
+func (this *Scheduler) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		busy := false
+		for set, dispatch := range this.snapshot() {
+			n, err := this.poll(set, dispatch)
+			if err == nil && n > 0 && n >= this.batch() {
+				busy = true
+			}
+		}
+
+		// 还有积压的到期消息时不等待
+		if !busy && !sleepContext(ctx, this.Interval) {
+			return
+		}
+	}
+}
+
+func (this *Scheduler) snapshot() map[string]LazyDispatcher {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	handlers := make(map[string]LazyDispatcher, len(this.handlers))
+	for set, dispatch := range this.handlers {
+		handlers[set] = dispatch
+	}
+
+	return handlers
+}
+
+// 单次取出的数量，Batch不大于0时按1处理
+func (this *Scheduler) batch() int {
+	if this.Batch <= 0 {
+		return 1
+	}
+	return this.Batch
+}
+
+// 取出一批到期消息并派发，返回取出的数量
+func (this *Scheduler) poll(set string, dispatch LazyDispatcher) (int, error) {
+	msgids, err := this.store.ClaimLazyMsg(set, this.batch())
+	if err != nil {
+		return 0, err
+	}
+
+	for _, msgid := range msgids {
+		if !this.dispatchLazyMsg(dispatch, set, msgid) {
+			this.retryLazyMsg(set, msgid)
+		}
+	}
+
+	return len(msgids), nil
+}
+
+// 派发失败的消息已从集合中取出，重新放回失败时消息就丢失了，通过ErrorHook报告
+func (this *Scheduler) retryLazyMsg(set, msgid string) {
+	var err error
+	defer this.store.guard("LazyReschedule", &err)
+	if _, e := this.store.NewLazyMsg(set, time.Now().Add(this.RetryDelay), msgid); e != nil {
+		err = fmt.Errorf("msgstore: lazy message %s in %s lost: %v", msgid, set, e)
+	}
+}
+
+// 派发单个消息，回调出错或panic都视为失败，panic通过ErrorHook报告
+func (this *Scheduler) dispatchLazyMsg(dispatch LazyDispatcher, set, msgid string) (ok bool) {
+	var err error
+	defer this.store.guard("LazyDispatcher", &err)
+	return dispatch(set, msgid) == nil
+}
+
+// 原子地取出并删除到期的延时消息，最多count个
+func (this *Redis) ClaimLazyMsg(set string, count int) (_ []string, err error) {
+	defer this.guard("ClaimLazyMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	// 迁移期间新集合取不满时再从旧集合取
+	var msgids []string
+	ranges := this.rangeArgs(time.Time{}, time.Now())
+	for _, k := range this.readKeys() {
+		if len(msgids) >= count {
+			break
+		}
+
+		args := redis.Args{k.Lazy(set), count - len(msgids)}
+		ids, err := redis.Strings(claimLazyScript.Do(rc, append(args, ranges...)...))
+		if err != nil {
+			return msgids, err
+		}
+		msgids = append(msgids, ids...)
+	}
+
+	return msgids, nil
+}
+
+// 修改尚未派发的延时消息的派发时间，返回消息是否存在
+func (this *Redis) RescheduleLazyMsg(set, msgid string, tm time.Time) (_ bool, err error) {
+	defer this.guard("RescheduleLazyMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	for _, k := range this.readKeys() {
+		// XX只更新已存在的成员，CH使返回值为被修改的数量
+		key := k.Lazy(set)
+		c, err := redis.Int64(rc.Do("ZADD", key, "XX", "CH", this.score(tm), msgid))
+		if err != nil {
+			return false, err
+		}
+		if c > 0 {
+			return true, nil
+		}
+
+		// 派发时间没有变化时CH也返回0，需要再确认一次
+		score, err := rc.Do("ZSCORE", key, msgid)
+		if err != nil || score != nil {
+			return score != nil, err
+		}
+	}
+
+	return false, nil
+}
+
+// 取消尚未派发的延时消息，返回取消的数量0|1
+func (this *Redis) CancelLazyMsg(set, msgid string) (_ int64, err error) {
+	defer this.guard("CancelLazyMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	keys := this.readKeysOf(func(k KeyScheme) string { return k.Lazy(set) })
+	return removeFromAll(rc, keys, msgid)
+}
@@ -0,0 +1,92 @@
+package MsgStore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClaimLazyMsg(t *testing.T) {
+	s, _ := newTestRedis(t)
+	past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+
+	for msgid, tm := range map[string]time.Time{"l-1": past, "l-2": past, "l-3": future, "l-4": future} {
+		if _, err := s.NewLazyMsg("lz", tm, msgid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ok, err := s.RescheduleLazyMsg("lz", "l-3", past)
+	if err != nil || !ok {
+		t.Fatalf("RescheduleLazyMsg = %v, %v", ok, err)
+	}
+	// 派发时间不变时也算存在
+	if ok, err := s.RescheduleLazyMsg("lz", "l-4", future); err != nil || !ok {
+		t.Errorf("RescheduleLazyMsg unchanged = %v, %v", ok, err)
+	}
+	if ok, err := s.RescheduleLazyMsg("lz", "l-9", past); err != nil || ok {
+		t.Errorf("RescheduleLazyMsg missing = %v, %v", ok, err)
+	}
+	n, err := s.CancelLazyMsg("lz", "l-2")
+	expectInt(t, "CancelLazyMsg", n, err, 1)
+
+	// 只取到期的，取出后不会再被取到
+	ids, err := s.ClaimLazyMsg("lz", 10)
+	expectIDs(t, "ClaimLazyMsg", ids, err, "l-1", "l-3")
+	ids, err = s.ClaimLazyMsg("lz", 10)
+	expectIDs(t, "ClaimLazyMsg again", ids, err)
+
+	// GetLazyMsg只查看到期的，不删除
+	if _, err := s.RescheduleLazyMsg("lz", "l-4", past); err != nil {
+		t.Fatal(err)
+	}
+	ids, err = s.GetLazyMsg("lz")
+	expectIDs(t, "GetLazyMsg", ids, err, "l-4")
+	ids, err = s.ClaimLazyMsg("lz", 10)
+	expectIDs(t, "ClaimLazyMsg after GetLazyMsg", ids, err, "l-4")
+}
+
+func TestSchedulerRetry(t *testing.T) {
+	s, _ := newTestRedis(t)
+	if _, err := s.NewLazyMsg("lz", time.Now(), "l-5"); err != nil {
+		t.Fatal(err)
+	}
+
+	sched := s.NewScheduler()
+	sched.Interval = 5 * time.Millisecond
+	sched.RetryDelay = 10 * time.Millisecond
+
+	// 第一次派发失败，重试间隔后再次派发
+	calls := 0
+	done := make(chan struct{})
+	sched.Handle("lz", func(set, msgid string) error {
+		calls++
+		if calls == 1 {
+			return errors.New("busy")
+		}
+		close(done)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		sched.Run(ctx)
+		close(finished)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("message was not redispatched")
+	}
+	cancel()
+	<-finished
+
+	if calls != 2 {
+		t.Errorf("dispatched %d times, want 2", calls)
+	}
+	ids, err := s.GetLazyMsg("lz")
+	expectIDs(t, "GetLazyMsg after dispatch", ids, err)
+}
@@ -0,0 +1,263 @@
+package MsgStore
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/6xiao/go/Common"
+	"github.com/garyburd/redigo/redis"
+)
+
+// 有序集合score的编码
+// 旧格式为NumberTime的十进制拼接，如20060102150405999，不能做加减，跨月的区间也不直观
+// 新格式为Unix毫秒数，两种格式的数值范围不重叠：毫秒数小于score_PACKED_MIN，拼接格式不小于它
+// 切换步骤：UseScoreCodec(DualScores) -> MigrateScores -> UseScoreCodec(MillisScores)
+
+// 拼接格式的最小值，对应公元100年，毫秒格式在公元33658年之前都小于它
+const score_PACKED_MIN = 1000000000000000
+
+// 一个score区间，Min和Max为ZRANGEBYSCORE的参数
+type ScoreRange struct {
+	Min interface{}
+	Max interface{}
+}
+
+// score的编码方式，Encode用于写入，Ranges把时间区间[min, max]换成需要查询的score区间，零值时间表示不限制
+type ScoreCodec interface {
+	Encode(tm time.Time) int64
+	Ranges(min, max time.Time) []ScoreRange
+}
+
+type packedCodec struct{}
+type millisCodec struct{}
+type dualCodec struct{}
+
+var (
+	PackedScores ScoreCodec = packedCodec{} // 旧格式，默认
+	MillisScores ScoreCodec = millisCodec{} // 新格式
+	DualScores   ScoreCodec = dualCodec{}   // 写新格式，读两种格式，用于迁移期间
+)
+
+func (packedCodec) Encode(tm time.Time) int64 {
+	return encodePacked(tm)
+}
+
+func (packedCodec) Ranges(min, max time.Time) []ScoreRange {
+	return []ScoreRange{{bound(min, encodePacked, "-inf"), bound(max, encodePacked, "+inf")}}
+}
+
+func (millisCodec) Encode(tm time.Time) int64 {
+	return encodeMillis(tm)
+}
+
+// 不限制上限时也排除尚未迁移的旧格式
+func (millisCodec) Ranges(min, max time.Time) []ScoreRange {
+	return []ScoreRange{{bound(min, encodeMillis, "-inf"), bound(max, encodeMillis, "("+strconv.Itoa(score_PACKED_MIN))}}
+}
+
+func (dualCodec) Encode(tm time.Time) int64 {
+	return encodeMillis(tm)
+}
+
+func (dualCodec) Ranges(min, max time.Time) []ScoreRange {
+	return []ScoreRange{
+		{bound(min, encodeMillis, "-inf"), bound(max, encodeMillis, "("+strconv.Itoa(score_PACKED_MIN))},
+		{bound(min, encodePacked, score_PACKED_MIN), bound(max, encodePacked, "+inf")},
+	}
+}
+
+func bound(tm time.Time, encode func(time.Time) int64, unbounded interface{}) interface{} {
+	if tm.IsZero() {
+		return unbounded
+	}
+	return encode(tm)
+}
+
+func encodeMillis(tm time.Time) int64 {
+	return tm.UnixNano() / int64(time.Millisecond)
+}
+
+func encodePacked(tm time.Time) int64 {
+	return int64(Common.NumberTime(tm))
+}
+
+// 把score还原为时间，自动识别两种格式，score不大于0时返回零值
+// 拼接格式的score是双精度浮点数，毫秒位可能有几毫秒的误差，用time.Date处理进位
+func DecodeScore(score float64) time.Time {
+	n := int64(score)
+	if n <= 0 {
+		return time.Time{}
+	}
+
+	if n < score_PACKED_MIN {
+		return time.Unix(0, n*int64(time.Millisecond))
+	}
+
+	ms, n := n%1000, n/1000
+	sec, n := n%100, n/100
+	min, n := n%100, n/100
+	hour, n := n%100, n/100
+	day, n := n%100, n/100
+	mon, year := n%100, n/100
+	return time.Date(int(year), time.Month(mon), int(day), int(hour), int(min), int(sec),
+		int(ms)*int(time.Millisecond), time.Local)
+}
+
+// 切换score的编码方式
+func (this *Redis) UseScoreCodec(codec ScoreCodec) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.codec = codec
+}
+
+// 当前使用的score编码方式
+func (this *Redis) scores() ScoreCodec {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if this.codec == nil {
+		return PackedScores
+	}
+	return this.codec
+}
+
+// 时间转为当前编码方式的score
+func (this *Redis) score(tm time.Time) int64 {
+	return this.scores().Encode(tm)
+}
+
+// 时间区间转为脚本参数：区间数量，然后是每个区间的min max
+func (this *Redis) rangeArgs(min, max time.Time) redis.Args {
+	ranges := this.scores().Ranges(min, max)
+	args := redis.Args{len(ranges)}
+	for _, r := range ranges {
+		args = args.Add(r.Min, r.Max)
+	}
+
+	return args
+}
+
+// 依次读取多个有序集合中score在时间区间[min, max]之间的成员，合并后去重
+func (this *Redis) rangeByTime(rc redis.Conn, keys []string, min, max time.Time) ([]string, error) {
+	var res []string
+	seen := make(map[string]bool)
+	for _, r := range this.scores().Ranges(min, max) {
+		members, err := rangeByScore(rc, keys, r.Min, r.Max)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range members {
+			if !seen[m] {
+				seen[m] = true
+				res = append(res, m)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// 把有序集合中拼接格式的score改为毫秒格式，成员的score在读取后被改写过的不覆盖
+// KEYS: 有序集合
+// ARGV: 成员 旧score 新score...
+var migrateScoreScript = redis.NewScript(1, `
+local n = 0
+for i = 1, #ARGV, 3 do
+	local cur = redis.call('ZSCORE', KEYS[1], ARGV[i])
+	if cur and tonumber(cur) == tonumber(ARGV[i + 1]) then
+		redis.call('ZADD', KEYS[1], ARGV[i + 2], ARGV[i])
+		n = n + 1
+	end
+end
+return n
+`)
+
+// score迁移的统计
+type ScoreMigrateStats struct {
+	Keys      int64 // 处理过的有序集合数量
+	Rewritten int64 // 改写的成员数量
+}
+
+// 把用户、设备、群组消息、_pushed和_rejected历史以及lazySets中的score改写为毫秒格式，可以重复执行
+// 前四种有序集合从登记集合中遍历，延时消息集合没有登记，需要由参数给出
+// 迁移期间应使用DualScores，新写入的已是毫秒格式
+func (this *Redis) MigrateScores(lazySets ...string) (_ ScoreMigrateStats, err error) {
+	defer this.guard("MigrateScores", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	var stats ScoreMigrateStats
+	migrate := func(key string) error {
+		stats.Keys++
+		n, err := migrateScores(rc, key)
+		stats.Rewritten += n
+
+		// 登记集合中可能有已被删除后又用作其他类型的key
+		if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "WRONGTYPE") {
+			return nil
+		}
+		return err
+	}
+
+	for _, k := range this.readKeys() {
+		cursor := int64(0)
+		for {
+			res, err := redis.Values(rc.Do("SSCAN", k.Registry(), cursor, "COUNT", gc_BATCH))
+			if err != nil {
+				return stats, err
+			}
+
+			var keys []string
+			if _, err := redis.Scan(res, &cursor, &keys); err != nil {
+				return stats, err
+			}
+
+			for _, key := range keys {
+				if err := migrate(key); err != nil {
+					return stats, err
+				}
+			}
+
+			if cursor == 0 {
+				break
+			}
+		}
+
+		for _, set := range lazySets {
+			if err := migrate(k.Lazy(set)); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// 分批改写一个有序集合，改写后的成员离开查询区间，直到区间为空
+func migrateScores(rc redis.Conn, key string) (int64, error) {
+	var total int64
+	for {
+		res, err := redis.Strings(rc.Do("ZRANGEBYSCORE", key, score_PACKED_MIN, "+inf", "WITHSCORES", "LIMIT", 0, gc_BATCH))
+		if err != nil || len(res) == 0 {
+			return total, err
+		}
+
+		args := redis.Args{key}
+		for i := 0; i+1 < len(res); i += 2 {
+			score, err := strconv.ParseFloat(res[i+1], 64)
+			if err != nil {
+				return total, err
+			}
+			args = args.Add(res[i], res[i+1], encodeMillis(DecodeScore(score)))
+		}
+
+		n, err := redis.Int64(migrateScoreScript.Do(rc, args...))
+		total += n
+		if err != nil || n == 0 {
+			return total, err
+		}
+	}
+}
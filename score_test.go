@@ -0,0 +1,26 @@
+package MsgStore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeScore(t *testing.T) {
+	tm := time.Date(2024, 3, 5, 10, 20, 30, 123*int(time.Millisecond), time.Local)
+
+	if got := DecodeScore(float64(encodeMillis(tm))); !got.Equal(tm) {
+		t.Errorf("millis: got %v, want %v", got, tm)
+	}
+
+	// 拼接格式超出双精度浮点数的精确范围，允许几毫秒的误差
+	got := DecodeScore(float64(encodePacked(tm)))
+	if d := got.Sub(tm); d < -5*time.Millisecond || d > 5*time.Millisecond {
+		t.Errorf("packed: got %v, want %v", got, tm)
+	}
+
+	for _, score := range []float64{0, -1} {
+		if got := DecodeScore(score); !got.IsZero() {
+			t.Errorf("DecodeScore(%v) = %v, want zero", score, got)
+		}
+	}
+}
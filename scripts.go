@@ -0,0 +1,100 @@
+package MsgStore
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// 服务端脚本
+// redis.Script先用EVALSHA执行，服务端返回NOSCRIPT时（重启、故障切换、SCRIPT FLUSH）自动用EVAL重新加载
+
+// 标记发送过群组消息的用户，迁移期间依次尝试新旧两个标记集合
+// 若TTL不大于0，则该集合大限已到，不用标记了，返回-1；为了防止key泄露，标记后重新设置TTL
+// KEYS: 标记集合...
+// ARGV: userFlag
+var markGroupScript = redis.NewScript(-1, `
+for _, key in ipairs(KEYS) do
+	local ttl = redis.call('TTL', key)
+	if ttl > 0 then
+		local n = redis.call('SADD', key, ARGV[1])
+		redis.call('EXPIRE', key, ttl)
+		return n
+	end
+end
+return -1
+`)
+
+// 取生存期内用户没有收到过的群组消息，标记集合的key为标记前缀加msgid
+// 消息在任一前缀的标记集合中都算收到过
+// 标记集合的key取决于有序集合中的msgid，在脚本中由前缀拼成，没有在KEYS中声明，只能用于单节点redis，不能用于集群
+// KEYS: 群组消息有序集合...
+// ARGV: userFlag 区间数量 min max... 标记前缀...
+var unreadGroupScript = redis.NewScript(-1, `
+local ret, seen = {}, {}
+local nr = tonumber(ARGV[2])
+for _, key in ipairs(KEYS) do
+	for j = 1, nr do
+		for _, msgid in ipairs(redis.call('ZRANGEBYSCORE', key, ARGV[2 * j + 1], ARGV[2 * j + 2])) do
+			if not seen[msgid] then
+				seen[msgid] = true
+				local marked = false
+				for i = 2 * nr + 3, #ARGV do
+					if redis.call('SISMEMBER', ARGV[i] .. msgid, ARGV[1]) == 1 then
+						marked = true
+						break
+					end
+				end
+				if not marked then
+					ret[#ret + 1] = msgid
+				end
+			end
+		end
+	end
+end
+return ret
+`)
+
+// 所有需要预加载的脚本
+var allScripts = []*redis.Script{
+	popReliableScript,
+	ackReliableScript,
+	reapReliableScript,
+	claimLazyScript,
+	collectZSetScript,
+	markGroupScript,
+	unreadGroupScript,
+	migrateKeyScript,
+	claimRequestScript,
+	completeRequestScript,
+	releaseRequestScript,
+	reserveTimeIDScript,
+	recordEventScript,
+	incrBoundedScript,
+	decrFloorScript,
+	compareAndResetScript,
+	capScript,
+	migrateScoreScript,
+	sendToUserScript,
+	markFanoutScript,
+	groupCoverageScript,
+	unreadCountScript,
+	markGroupReadScript,
+	trackScript,
+	recallBatchScript,
+	deliveredScript,
+	collectExpiredScript,
+}
+
+// 预加载所有脚本，避免第一次执行时传输脚本内容，可在启动或redis故障切换后调用
+func (this *Redis) LoadScripts() (err error) {
+	defer this.guard("LoadScripts", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	for _, script := range allScripts {
+		if err := script.Load(rc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
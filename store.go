@@ -0,0 +1,94 @@
+package MsgStore
+
+import (
+	"time"
+)
+
+// 消息存储接口，Redis是基于redis的实现，Memory是内存实现，用于单元测试和单机部署
+// 广播队列的消费组、可靠队列、后台清理等依赖redis服务端特性的子系统只有Redis提供
+// 出错时返回的错误可以用errors.Is和ErrQueueEmpty、ErrExpired、ErrUnavailable比较
+type MsgStore interface {
+	NewMsgID(key string) (int64, error)
+
+	MarkRequest(key, value string, ttl int) error
+	GetRequest(key string) (string, error)
+	ClaimRequest(key, msgid string, lease time.Duration) (*RequestClaim, error)
+	CompleteRequest(key, msgid string, ttl int) (bool, error)
+	ReleaseRequest(key, msgid string) error
+
+	PublishNewMsg(queue string, msg []byte) (int64, error)
+	GetPublishMsg(queue string) ([]byte, error)
+
+	NewLazyMsg(set string, tm time.Time, msgid string) (int64, error)
+	GetLazyMsg(set string) ([]string, error)
+	ClaimLazyMsg(set string, count int) ([]string, error)
+	RescheduleLazyMsg(set, msgid string, tm time.Time) (bool, error)
+	CancelLazyMsg(set, msgid string) (int64, error)
+
+	NewGroupMsg(key, msgid string, ttl int) (int64, error)
+	MarkGroupMsg(reject bool, userid int64, userFlag, msgid string) (int64, error)
+	GetGroupMsg(key, userFlag string) ([]string, error)
+	DeleteMsg(key, msgid string) (int64, error)
+	DeleteGroupMsg(key, msgid string) (int64, error)
+	IsGroupMsgExist(key, msgid string) (bool, error)
+	RecallMsg(msgid string) (*RecallResult, error)
+	IsRecalled(msgid string) (bool, error)
+
+	JoinGroup(key string, userFlags ...string) (int64, error)
+	LeaveGroup(key string, userFlags ...string) (int64, error)
+	GetGroupMembers(key string) ([]string, error)
+	CountGroupMembers(key string) (int64, error)
+	IsGroupMember(key, userFlag string) (bool, error)
+	GetMemberGroupMsg(key, userFlag string) ([]string, error)
+	GetGroupCoverage(key, msgid string) (*GroupCoverage, error)
+	GetUndeliveredMembers(key, msgid string) ([]string, error)
+
+	NewDeviceMsg(devicekey string, ttl int, msgid string) (int64, error)
+	MarkDeviceMsg(devicekey, msgid string) (int64, error)
+	DeleteDeviceMsg(devicekey, msgid string) (int64, error)
+	GetDeviceMsg(devicekey string) ([]string, error)
+
+	BindDevice(userid int64, devicekey string) (int64, error)
+	UnbindDevice(userid int64, devicekey string) (int64, error)
+	TouchDevice(userid int64, devicekey string) (bool, error)
+	GetUserDevices(userid int64, activeWithin time.Duration) ([]*UserDevice, error)
+	SendToUser(userid int64, ttl int, msgid string, activeWithin time.Duration) ([]string, error)
+	MarkUserDeviceMsg(userid int64, devicekey, msgid string) (int64, error)
+	GetFanoutState(userid int64, msgid string) (*FanoutState, error)
+	IsDeliveredToAny(userid int64, msgid string) (bool, error)
+
+	SaveMsg(env *Envelope, ttl int) error
+	GetMsgs(ids ...string) ([]*Envelope, error)
+	GetUserEnvelopes(userid int64) ([]*Envelope, error)
+	GetDeviceEnvelopes(devicekey string) ([]*Envelope, error)
+	GetGroupEnvelopes(key, userFlag string) ([]*Envelope, error)
+
+	NewUserMsg(userid int64, ttl int, msgid string) (int64, error)
+	MarkUserMsg(reject bool, userid int64, msgid string) (int64, error)
+	DeleteUserMsg(userid int64, msgid string) (int64, error)
+	GetPushedUserMsg(userid int64) (send []string, rej []string, out []string, err error)
+	GetUserHistory(userid int64, q HistoryQuery) ([]*HistoryItem, error)
+	GetUserMsg(userid int64) ([]string, error)
+	CountUnread(userid int64, devicekey, userFlag string, groups ...string) (*UnreadCount, error)
+
+	GetAckedMsg(hashtable string) ([]string, error)
+	AddMsgAck(hashtable, msgid string) (int64, error)
+	GetMsgAck(hashtable, msgid string) (int64, error)
+	ResetMsgAck(hashtable, msgid string, count int64) error
+
+	ClearOutDateMsg(keeptime int) (int64, error)
+
+	MarkOfficialMsg(msgid string, ttl int64) error
+	IsOfficialMsg(msgid string) (bool, error)
+	MarkOfficialDevice(devicekey string) (int64, error)
+	FullOfficialDevice(devicekey string) (bool, error)
+	MarkOfficialDeviceIn(devicekey string, loc *time.Location) (int64, error)
+	FullOfficialDeviceIn(devicekey string, loc *time.Location) (bool, error)
+
+	SetCapPolicy(category string, rules []CapRule) error
+	AcquireCap(subject, category, msgid string) (bool, time.Time, error)
+	CheckCap(subject, category string) (bool, time.Time, error)
+}
+
+var _ MsgStore = (*Redis)(nil)
+var _ MsgStore = (*Memory)(nil)
@@ -0,0 +1,437 @@
+package MsgStore
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// MsgStore的契约测试，同样的用例对Memory和Redis运行，Redis使用miniredis，服务端脚本也一起测试
+
+func TestMemoryContract(t *testing.T) {
+	s := NewMemoryStore()
+	s.EnableRecall()
+	testStoreContract(t, s)
+}
+
+func TestRedisContract(t *testing.T) {
+	s, _ := newTestRedis(t)
+	s.EnableRecall()
+	testStoreContract(t, s)
+}
+
+// 连接一个只用于当前测试的miniredis，测试结束时关闭，需要快进时间的测试使用返回的miniredis
+func newTestRedis(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	return NewMutableStore(mr.Addr(), 0), mr
+}
+
+func testStoreContract(t *testing.T, s MsgStore) {
+	t.Run("UserMsg", func(t *testing.T) { testUserMsg(t, s) })
+	t.Run("DeviceMsg", func(t *testing.T) { testDeviceMsg(t, s) })
+	t.Run("GroupMsg", func(t *testing.T) { testGroupMsg(t, s) })
+	t.Run("GroupMsgInGroups", func(t *testing.T) { testGroupMsgInGroups(t, s) })
+	t.Run("LazyMsg", func(t *testing.T) { testLazyMsg(t, s) })
+	t.Run("Envelope", func(t *testing.T) { testEnvelope(t, s) })
+	t.Run("Recall", func(t *testing.T) { testRecall(t, s) })
+	t.Run("Request", func(t *testing.T) { testRequest(t, s) })
+	t.Run("MsgAck", func(t *testing.T) { testMsgAck(t, s) })
+	t.Run("Fanout", func(t *testing.T) { testFanout(t, s) })
+	t.Run("OfficialDevice", func(t *testing.T) { testOfficialDevice(t, s) })
+	t.Run("OfficialPolicy", func(t *testing.T) { testOfficialPolicy(t, s) })
+}
+
+func expectInt(t *testing.T, what string, n int64, err error, want int64) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	if n != want {
+		t.Fatalf("%s = %d, want %d", what, n, want)
+	}
+}
+
+func expectIDs(t *testing.T, what string, ids []string, err error, want ...string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+
+	got := append([]string{}, ids...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(got) != len(want) || (len(got) > 0 && !reflect.DeepEqual(got, want)) {
+		t.Fatalf("%s = %v, want %v", what, got, want)
+	}
+}
+
+func testUserMsg(t *testing.T, s MsgStore) {
+	n, err := s.NewUserMsg(1001, 60, "u-1")
+	expectInt(t, "NewUserMsg", n, err, 1)
+	n, err = s.NewUserMsg(1001, 60, "u-1")
+	expectInt(t, "NewUserMsg again", n, err, 0)
+	n, err = s.NewUserMsg(0, 60, "u-1")
+	expectInt(t, "NewUserMsg userid 0", n, err, 0)
+	n, err = s.NewUserMsg(1001, 60, "u-2")
+	expectInt(t, "NewUserMsg", n, err, 1)
+
+	ids, err := s.GetUserMsg(1001)
+	expectIDs(t, "GetUserMsg", ids, err, "u-1", "u-2")
+
+	c, err := s.CountUnread(1001, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.User != 2 || c.Total() != 2 {
+		t.Fatalf("CountUnread = %+v, want 2 user messages", c)
+	}
+
+	n, err = s.MarkUserMsg(false, 1001, "u-1")
+	expectInt(t, "MarkUserMsg", n, err, 1)
+	n, err = s.DeleteUserMsg(1001, "u-2")
+	expectInt(t, "DeleteUserMsg", n, err, 1)
+	n, err = s.DeleteUserMsg(1001, "u-2")
+	expectInt(t, "DeleteUserMsg again", n, err, 0)
+
+	ids, err = s.GetUserMsg(1001)
+	expectIDs(t, "GetUserMsg after mark", ids, err)
+
+	send, rej, _, err := s.GetPushedUserMsg(1001)
+	expectIDs(t, "pushed", send, err, "u-1")
+	expectIDs(t, "rejected", rej, err)
+}
+
+func testDeviceMsg(t *testing.T, s MsgStore) {
+	n, err := s.NewDeviceMsg("dev-1", 60, "d-1")
+	expectInt(t, "NewDeviceMsg", n, err, 1)
+	n, err = s.NewDeviceMsg("dev-1", 60, "d-2")
+	expectInt(t, "NewDeviceMsg", n, err, 1)
+
+	ids, err := s.GetDeviceMsg("dev-1")
+	expectIDs(t, "GetDeviceMsg", ids, err, "d-1", "d-2")
+
+	n, err = s.MarkDeviceMsg("dev-1", "d-1")
+	expectInt(t, "MarkDeviceMsg", n, err, 1)
+	n, err = s.DeleteDeviceMsg("dev-1", "d-2")
+	expectInt(t, "DeleteDeviceMsg", n, err, 1)
+
+	ids, err = s.GetDeviceMsg("dev-1")
+	expectIDs(t, "GetDeviceMsg after mark", ids, err)
+}
+
+func testGroupMsgInGroups(t *testing.T, s MsgStore) {
+	// 同一消息发到两个群组，标记后两个群组都计为已读
+	for _, group := range []string{"grp-a", "grp-b"} {
+		n, err := s.NewGroupMsg(group, "g-ab", 60)
+		expectInt(t, "NewGroupMsg "+group, n, err, 1)
+	}
+
+	n, err := s.MarkGroupMsg(false, 0, "carol", "g-ab")
+	expectInt(t, "MarkGroupMsg", n, err, 1)
+
+	c, err := s.CountUnread(0, "", "carol", "grp-a", "grp-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Groups["grp-a"] != 0 || c.Groups["grp-b"] != 0 || c.Group != 0 {
+		t.Fatalf("CountUnread = %+v, want no group messages", c)
+	}
+
+	c, err = s.CountUnread(0, "", "dave", "grp-a", "grp-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Groups["grp-a"] != 1 || c.Groups["grp-b"] != 1 {
+		t.Fatalf("CountUnread(dave) = %+v, want one message in each group", c)
+	}
+}
+
+func testGroupMsg(t *testing.T, s MsgStore) {
+	n, err := s.NewGroupMsg("grp-1", "g-1", 60)
+	expectInt(t, "NewGroupMsg", n, err, 1)
+	n, err = s.NewGroupMsg("grp-1", "g-2", 60)
+	expectInt(t, "NewGroupMsg", n, err, 1)
+
+	n, err = s.MarkGroupMsg(false, 0, "alice", "g-1")
+	expectInt(t, "MarkGroupMsg", n, err, 1)
+	n, err = s.MarkGroupMsg(false, 0, "alice", "g-1")
+	expectInt(t, "MarkGroupMsg again", n, err, 0)
+
+	ids, err := s.GetGroupMsg("grp-1", "alice")
+	expectIDs(t, "GetGroupMsg alice", ids, err, "g-2")
+	ids, err = s.GetGroupMsg("grp-1", "bob")
+	expectIDs(t, "GetGroupMsg bob", ids, err, "g-1", "g-2")
+
+	for flag, want := range map[string]int64{"alice": 1, "bob": 2} {
+		c, err := s.CountUnread(0, "", flag, "grp-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Groups["grp-1"] != want || c.Group != want {
+			t.Fatalf("CountUnread(%s) = %+v, want %d group messages", flag, c, want)
+		}
+	}
+
+	ok, err := s.IsGroupMsgExist("grp-1", "g-2")
+	if err != nil || !ok {
+		t.Fatalf("IsGroupMsgExist = %v, %v", ok, err)
+	}
+	n, err = s.DeleteGroupMsg("grp-1", "g-2")
+	expectInt(t, "DeleteGroupMsg", n, err, 1)
+	ok, err = s.IsGroupMsgExist("grp-1", "g-2")
+	if err != nil || ok {
+		t.Fatalf("IsGroupMsgExist after delete = %v, %v", ok, err)
+	}
+
+	n, err = s.JoinGroup("grp-1", "alice", "bob")
+	expectInt(t, "JoinGroup", n, err, 2)
+	n, err = s.CountGroupMembers("grp-1")
+	expectInt(t, "CountGroupMembers", n, err, 2)
+	n, err = s.LeaveGroup("grp-1", "bob")
+	expectInt(t, "LeaveGroup", n, err, 1)
+	ok, err = s.IsGroupMember("grp-1", "bob")
+	if err != nil || ok {
+		t.Fatalf("IsGroupMember after leave = %v, %v", ok, err)
+	}
+}
+
+func testLazyMsg(t *testing.T, s MsgStore) {
+	n, err := s.NewLazyMsg("lazy-1", time.Now().Add(-time.Second), "l-1")
+	expectInt(t, "NewLazyMsg", n, err, 1)
+	n, err = s.NewLazyMsg("lazy-1", time.Now().Add(time.Hour), "l-2")
+	expectInt(t, "NewLazyMsg", n, err, 1)
+
+	ids, err := s.GetLazyMsg("lazy-1")
+	expectIDs(t, "GetLazyMsg", ids, err, "l-1")
+
+	ids, err = s.ClaimLazyMsg("lazy-1", 0)
+	expectIDs(t, "ClaimLazyMsg 0", ids, err)
+	ids, err = s.ClaimLazyMsg("lazy-1", 10)
+	expectIDs(t, "ClaimLazyMsg", ids, err, "l-1")
+	ids, err = s.ClaimLazyMsg("lazy-1", 10)
+	expectIDs(t, "ClaimLazyMsg again", ids, err)
+
+	ok, err := s.RescheduleLazyMsg("lazy-1", "l-2", time.Now().Add(-time.Second))
+	if err != nil || !ok {
+		t.Fatalf("RescheduleLazyMsg = %v, %v", ok, err)
+	}
+	n, err = s.CancelLazyMsg("lazy-1", "l-2")
+	expectInt(t, "CancelLazyMsg", n, err, 1)
+	ids, err = s.GetLazyMsg("lazy-1")
+	expectIDs(t, "GetLazyMsg after cancel", ids, err)
+}
+
+func testEnvelope(t *testing.T, s MsgStore) {
+	env := &Envelope{MsgID: "e-1", Sender: "system", Type: "text", Body: []byte("hello")}
+	if err := s.SaveMsg(env, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	envs, err := s.GetMsgs("e-1", "e-missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 1 {
+		t.Fatalf("GetMsgs returned %d envelopes, want 1", len(envs))
+	}
+	got := envs[0]
+	if got.MsgID != "e-1" || got.Sender != "system" || got.Type != "text" || string(got.Body) != "hello" || got.Created.IsZero() {
+		t.Fatalf("GetMsgs = %+v", got)
+	}
+}
+
+func testRecall(t *testing.T, s MsgStore) {
+	if _, err := s.NewUserMsg(2001, 60, "r-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewDeviceMsg("dev-2", 60, "r-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MarkDeviceMsg("dev-2", "r-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveMsg(&Envelope{MsgID: "r-1", Body: []byte("oops")}, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	// 标记过的用户消息算已送达，删除的不算
+	for _, userid := range []int64{2002, 2003} {
+		if _, err := s.NewUserMsg(userid, 60, "r-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.MarkUserMsg(false, 2002, "r-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteUserMsg(2003, "r-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewDeviceMsg("dev-3", 60, "r-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteDeviceMsg("dev-3", "r-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.RecallMsg("r-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Removed != 1 || r.Delivered != 2 {
+		t.Fatalf("RecallMsg = %+v, want 1 removed and 2 delivered", r)
+	}
+
+	ids, err := s.GetUserMsg(2001)
+	expectIDs(t, "GetUserMsg after recall", ids, err)
+
+	ok, err := s.IsRecalled("r-1")
+	if err != nil || !ok {
+		t.Fatalf("IsRecalled = %v, %v", ok, err)
+	}
+	envs, err := s.GetMsgs("r-1")
+	if err != nil || len(envs) != 0 {
+		t.Fatalf("GetMsgs after recall = %v, %v", envs, err)
+	}
+
+	r, err = s.RecallMsg("r-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Removed != 0 || r.Delivered != 0 {
+		t.Fatalf("RecallMsg again = %+v, want zero", r)
+	}
+}
+
+// 没有启用投递记录时撤回不能删除待发送的消息，直接报错
+func TestRecallDisabled(t *testing.T) {
+	rs, _ := newTestRedis(t)
+	for name, s := range map[string]MsgStore{"Memory": NewMemoryStore(), "Redis": rs} {
+		if _, err := s.NewUserMsg(3001, 60, "r-2"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.RecallMsg("r-2"); !errors.Is(err, ErrRecallDisabled) {
+			t.Errorf("%s: RecallMsg = %v, want ErrRecallDisabled", name, err)
+		}
+		if ok, err := s.IsRecalled("r-2"); err != nil || ok {
+			t.Errorf("%s: IsRecalled = %v, %v, want false", name, ok, err)
+		}
+		ids, err := s.GetUserMsg(3001)
+		expectIDs(t, name+": GetUserMsg", ids, err, "r-2")
+	}
+}
+
+func testRequest(t *testing.T, s MsgStore) {
+	if err := s.MarkRequest("req-1", "m-1", 60); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := s.GetRequest("req-1")
+	if err != nil || v != "m-1" {
+		t.Fatalf("GetRequest = %q, %v", v, err)
+	}
+}
+
+func testMsgAck(t *testing.T, s MsgStore) {
+	n, err := s.AddMsgAck("ack-1", "a-1")
+	expectInt(t, "AddMsgAck", n, err, 1)
+	n, err = s.AddMsgAck("ack-1", "a-1")
+	expectInt(t, "AddMsgAck", n, err, 2)
+	n, err = s.GetMsgAck("ack-1", "a-1")
+	expectInt(t, "GetMsgAck", n, err, 2)
+}
+
+func testOfficialDevice(t *testing.T, s MsgStore) {
+	full, err := s.FullOfficialDevice("dev-3")
+	if err != nil || full {
+		t.Fatalf("FullOfficialDevice before = %v, %v", full, err)
+	}
+
+	n, err := s.MarkOfficialDevice("dev-3")
+	expectInt(t, "MarkOfficialDevice", n, err, 1)
+
+	full, err = s.FullOfficialDevice("dev-3")
+	if err != nil || !full {
+		t.Fatalf("FullOfficialDevice after = %v, %v", full, err)
+	}
+}
+
+func testOfficialPolicy(t *testing.T, s MsgStore) {
+	// 官方消息的设备限制使用配置的策略
+	if err := s.SetCapPolicy(CapOfficial, []CapRule{{Window: time.Hour, Max: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.SetCapPolicy(CapOfficial, nil)
+
+	for i := 0; i < 2; i++ {
+		n, err := s.MarkOfficialDevice("dev-4")
+		expectInt(t, "MarkOfficialDevice", n, err, 1)
+	}
+
+	full, err := s.FullOfficialDevice("dev-4")
+	if err != nil || !full {
+		t.Fatalf("FullOfficialDevice = %v, %v, want full", full, err)
+	}
+	n, err := s.MarkOfficialDevice("dev-4")
+	expectInt(t, "MarkOfficialDevice when full", n, err, 0)
+
+	ok, next, err := s.CheckCap("dev-4", CapOfficial)
+	if err != nil || ok || next.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("CheckCap = %v, %v, %v", ok, next, err)
+	}
+}
+
+func testFanout(t *testing.T, s MsgStore) {
+	for _, bind := range []struct {
+		userid    int64
+		devicekey string
+	}{{301, "dev-301a"}, {301, "dev-301b"}, {302, "dev-302"}} {
+		n, err := s.BindDevice(bind.userid, bind.devicekey)
+		expectInt(t, "BindDevice", n, err, 1)
+	}
+
+	// 同一个msgid发给两个用户，送达状态各自记录
+	devices, err := s.SendToUser(301, 60, "fan-1", 0)
+	expectIDs(t, "SendToUser 301", devices, err, "dev-301a", "dev-301b")
+	devices, err = s.SendToUser(302, 60, "fan-1", 0)
+	expectIDs(t, "SendToUser 302", devices, err, "dev-302")
+
+	ids, err := s.GetDeviceMsg("dev-301b")
+	expectIDs(t, "GetDeviceMsg", ids, err, "fan-1")
+
+	n, err := s.MarkUserDeviceMsg(301, "dev-301a", "fan-1")
+	expectInt(t, "MarkUserDeviceMsg", n, err, 1)
+
+	state, err := s.GetFanoutState(301, "fan-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Delivered["dev-301a"]; !ok || len(state.Delivered) != 1 {
+		t.Errorf("Delivered of 301 = %v", state.Delivered)
+	}
+	expectIDs(t, "Pending of 301", state.Pending, nil, "dev-301b")
+
+	state, err = s.GetFanoutState(302, "fan-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Delivered) != 0 {
+		t.Errorf("Delivered of 302 = %v, want none", state.Delivered)
+	}
+	expectIDs(t, "Pending of 302", state.Pending, nil, "dev-302")
+
+	if any, err := s.IsDeliveredToAny(302, "fan-1"); err != nil || any {
+		t.Errorf("IsDeliveredToAny(302) = %v, %v", any, err)
+	}
+
+	// 解绑的设备不再收到
+	n, err = s.UnbindDevice(301, "dev-301b")
+	expectInt(t, "UnbindDevice", n, err, 1)
+	devices, err = s.SendToUser(301, 60, "fan-2", 0)
+	expectIDs(t, "SendToUser after unbind", devices, err, "dev-301a")
+}
@@ -0,0 +1,234 @@
+package MsgStore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// STREAM广播队列，每个消费组独立地收到全部消息，组内的消费者分摊消息
+// 消息内容保存在条目的stream_FIELD字段中
+const stream_FIELD = "msg"
+
+type StreamMsg struct {
+	ID  string
+	Msg []byte
+}
+
+// 已读取但未确认的条目
+type PendingMsg struct {
+	ID       string
+	Consumer string
+	Idle     time.Duration // 距上次投递的时长
+	Delivery int64         // 投递次数
+}
+
+// 把广播队列切换为STREAM，之后PublishNewMsg使用XADD，maxLen大于0时近似地限制队列长度
+func (this *Redis) UseStreamQueue(queue string, maxLen int64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.streams[queue] = maxLen
+}
+
+// 把广播队列切换回LIST，已经写入STREAM的消息不会迁移
+func (this *Redis) UseListQueue(queue string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.streams, queue)
+}
+
+func (this *Redis) streamQueue(queue string) (int64, bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	maxLen, ok := this.streams[queue]
+	return maxLen, ok
+}
+
+// 写入STREAM，返回队列长度
+func (this *Redis) publishStreamMsg(queue string, maxLen int64, msg []byte) (_ int64, err error) {
+	defer this.guard("publishStreamMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	key := this.Keys().Queue(queue)
+	args := redis.Args{key}
+	if maxLen > 0 {
+		args = args.Add("MAXLEN", "~", maxLen)
+	}
+	if _, err := rc.Do("XADD", args.Add("*", stream_FIELD, msg)...); err != nil {
+		return 0, err
+	}
+
+	return redis.Int64(rc.Do("XLEN", key))
+}
+
+// 创建消费组，start为"$"时只消费创建后的新消息，为"0"时从头消费
+// 消费组已存在不算错误
+func (this *Redis) CreateStreamGroup(queue, group, start string) (err error) {
+	defer this.guard("CreateStreamGroup", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	_, err = rc.Do("XGROUP", "CREATE", this.Keys().Queue(queue), group, start, "MKSTREAM")
+	if e, ok := err.(redis.Error); ok && len(e) >= 9 && e[:9] == "BUSYGROUP" {
+		return nil
+	}
+
+	return err
+}
+
+// 以消费组的身份读取新消息，block大于0时最多阻塞该时长，超时返回空
+// 读取的消息需要AckStreamMsg确认，否则会留在待确认列表中
+func (this *Redis) ReadStreamMsg(queue, group, consumer string, count int, block time.Duration) (_ []StreamMsg, err error) {
+	defer this.guard("ReadStreamMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	args := redis.Args{"GROUP", group, consumer, "COUNT", count}
+	if block > 0 {
+		args = args.Add("BLOCK", int64(block/time.Millisecond))
+	}
+
+	res, err := redis.Values(rc.Do("XREADGROUP", args.Add("STREAMS", this.Keys().Queue(queue), ">")...))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 回复格式为[[queue, [entry...]]]，只读了一个STREAM
+	var stream []interface{}
+	if _, err := redis.Scan(res, &stream); err != nil {
+		return nil, err
+	}
+	if len(stream) != 2 {
+		return nil, fmt.Errorf("unexpected XREADGROUP reply for %s", queue)
+	}
+
+	return parseStreamEntries(stream[1], nil)
+}
+
+// 确认消息已处理，返回确认成功的数量
+func (this *Redis) AckStreamMsg(queue, group string, ids ...string) (_ int64, err error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	defer this.guard("AckStreamMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return redis.Int64(rc.Do("XACK", redis.Args{this.Keys().Queue(queue), group}.AddFlat(ids)...))
+}
+
+// 查看消费组中最多count个待确认的条目
+func (this *Redis) PendingStreamMsg(queue, group string, count int) (_ []PendingMsg, err error) {
+	defer this.guard("PendingStreamMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	res, err := redis.Values(rc.Do("XPENDING", this.Keys().Queue(queue), group, "-", "+", count))
+	if err != nil {
+		return nil, err
+	}
+
+	// 每个条目的格式为[id, consumer, idle, delivery]
+	pending := make([]PendingMsg, 0, len(res))
+	for _, v := range res {
+		entry, err := redis.Values(v, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var p PendingMsg
+		var idle int64
+		if _, err := redis.Scan(entry, &p.ID, &p.Consumer, &idle, &p.Delivery); err != nil {
+			return nil, err
+		}
+
+		p.Idle = time.Duration(idle) * time.Millisecond
+		pending = append(pending, p)
+	}
+
+	return pending, nil
+}
+
+// 把空闲超过minIdle的待确认条目转给consumer，返回认领成功的消息
+// 用于接管崩溃的消费者留下的消息
+func (this *Redis) ClaimStreamMsg(queue, group, consumer string, minIdle time.Duration, ids ...string) (_ []StreamMsg, err error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	defer this.guard("ClaimStreamMsg", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	args := redis.Args{this.Keys().Queue(queue), group, consumer, int64(minIdle / time.Millisecond)}.AddFlat(ids)
+	return parseStreamEntries(rc.Do("XCLAIM", args...))
+}
+
+// 认领消费组中所有空闲超过minIdle的条目，最多检查count个
+func (this *Redis) ClaimStaleStreamMsg(queue, group, consumer string, minIdle time.Duration, count int) ([]StreamMsg, error) {
+	pending, err := this.PendingStreamMsg(queue, group, count)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, p := range pending {
+		if p.Idle >= minIdle && p.Consumer != consumer {
+			ids = append(ids, p.ID)
+		}
+	}
+
+	return this.ClaimStreamMsg(queue, group, consumer, minIdle, ids...)
+}
+
+// 把STREAM的长度近似地裁剪到maxLen，返回删除的条目数量
+func (this *Redis) TrimStream(queue string, maxLen int64) (_ int64, err error) {
+	defer this.guard("TrimStream", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	return redis.Int64(rc.Do("XTRIM", this.Keys().Queue(queue), "MAXLEN", "~", maxLen))
+}
+
+// 解析[[id, [field, value, ...]], ...]格式的条目列表
+// 已被删除的条目的字段为nil，跳过
+func parseStreamEntries(reply interface{}, err error) ([]StreamMsg, error) {
+	entries, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]StreamMsg, 0, len(entries))
+	for _, e := range entries {
+		entry, err := redis.Values(e, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var m StreamMsg
+		var fields [][]byte
+		if _, err := redis.Scan(entry, &m.ID, &fields); err != nil {
+			return nil, err
+		}
+
+		for i := 0; i+1 < len(fields); i += 2 {
+			if string(fields[i]) == stream_FIELD {
+				m.Msg = fields[i+1]
+			}
+		}
+		if m.Msg != nil {
+			msgs = append(msgs, m)
+		}
+	}
+
+	return msgs, nil
+}
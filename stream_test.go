@@ -0,0 +1,69 @@
+package MsgStore
+
+import (
+	"testing"
+)
+
+func TestStreamGroups(t *testing.T) {
+	s, _ := newTestRedis(t)
+	s.UseStreamQueue("sq", 0)
+
+	for _, group := range []string{"g1", "g2"} {
+		if err := s.CreateStreamGroup("sq", group, "$"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 消费组已存在不算错误
+	if err := s.CreateStreamGroup("sq", "g1", "$"); err != nil {
+		t.Errorf("CreateStreamGroup again = %v", err)
+	}
+
+	for _, msg := range []string{"m1", "m2"} {
+		if _, err := s.PublishNewMsg("sq", []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.GetPublishMsg("sq"); err == nil {
+		t.Error("GetPublishMsg on a stream should fail")
+	}
+
+	// 每个消费组都收到全部消息，组内的消费者分摊
+	msgs, err := s.ReadStreamMsg("sq", "g1", "c1", 1, 0)
+	if err != nil || len(msgs) != 1 || string(msgs[0].Msg) != "m1" {
+		t.Fatalf("ReadStreamMsg g1/c1 = %+v, %v", msgs, err)
+	}
+	rest, err := s.ReadStreamMsg("sq", "g1", "c2", 10, 0)
+	if err != nil || len(rest) != 1 || string(rest[0].Msg) != "m2" {
+		t.Fatalf("ReadStreamMsg g1/c2 = %+v, %v", rest, err)
+	}
+	all, err := s.ReadStreamMsg("sq", "g2", "c1", 10, 0)
+	if err != nil || len(all) != 2 {
+		t.Fatalf("ReadStreamMsg g2 = %+v, %v", all, err)
+	}
+
+	if n, err := s.AckStreamMsg("sq", "g1", rest[0].ID); err != nil || n != 1 {
+		t.Errorf("AckStreamMsg = %d, %v", n, err)
+	}
+
+	pending, err := s.PendingStreamMsg("sq", "g1", 10)
+	if err != nil || len(pending) != 1 || pending[0].ID != msgs[0].ID || pending[0].Consumer != "c1" {
+		t.Fatalf("PendingStreamMsg = %+v, %v", pending, err)
+	}
+
+	// 接管c1留下的消息
+	claimed, err := s.ClaimStaleStreamMsg("sq", "g1", "c2", 0, 10)
+	if err != nil || len(claimed) != 1 || string(claimed[0].Msg) != "m1" {
+		t.Fatalf("ClaimStaleStreamMsg = %+v, %v", claimed, err)
+	}
+	pending, err = s.PendingStreamMsg("sq", "g1", 10)
+	if err != nil || len(pending) != 1 || pending[0].Consumer != "c2" {
+		t.Fatalf("PendingStreamMsg after claim = %+v, %v", pending, err)
+	}
+
+	if n, err := s.AckStreamMsg("sq", "g1", claimed[0].ID); err != nil || n != 1 {
+		t.Errorf("AckStreamMsg claimed = %d, %v", n, err)
+	}
+	if msgs, err := s.ReadStreamMsg("sq", "g1", "c1", 10, 0); err != nil || len(msgs) != 0 {
+		t.Errorf("ReadStreamMsg when drained = %+v, %v", msgs, err)
+	}
+}
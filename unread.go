@@ -0,0 +1,221 @@
+package MsgStore
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 未读数量，用于角标等只需要数量的场景
+// 用户消息和设备消息的数量在服务端按score区间用ZCOUNT计算，消息被标记或过期后立即反映在数量中
+// 群组消息不逐条检查标记集合，MarkGroupMsg在用户的群组已读集合中记录标记过的消息，score与群组消息集合中的相同，
+// 未读数量为群组消息集合与已读集合在生存期区间内ZCOUNT的差，过期的消息同时从两边的区间中消失
+// 群组已读集合依赖NewGroupMsg登记的消息所属群组，同一消息发到多个群组时每个群组都记录，
+// 登记之前写入的群组消息被标记后仍计为未读，直到过期
+// 删除或撤回的群组消息在原生存期内仍留在已读集合中，此时未读数量可能偏少，最小为0
+
+const key_GROUP_OF = "GroupOf-"
+const key_GROUP_READ = "GroupRead-"
+
+// 群组消息所属的群组集合
+func (k KeyScheme) GroupOf(msgid string) string {
+	if k.legacy() {
+		return key_GROUP_OF + msgid
+	}
+	return k.join("groupof", msgid)
+}
+
+// 用户在群组中标记过的群组消息
+func (k KeyScheme) GroupRead(key, userFlag string) string {
+	if k.legacy() {
+		return key_GROUP_READ + key + "-" + userFlag
+	}
+	return k.join("groupread:"+key, userFlag)
+}
+
+// 在用户的群组已读集合中记录标记过的消息，score取自群组消息集合，消息已不在群组中时不记录
+// 同时删除已过期的部分，生存期不短于标记集合
+// KEYS: 群组消息集合... 标记集合... 已读集合，群组消息集合和标记集合的数量相同
+// ARGV: msgid 区间数量 min max...，区间为已过期的部分
+var markGroupReadScript = redis.NewScript(-1, `
+local n = (#KEYS - 1) / 2
+local read = KEYS[#KEYS]
+local score
+for i = 1, n do
+	score = redis.call('ZSCORE', KEYS[i], ARGV[1])
+	if score then
+		break
+	end
+end
+if not score then
+	return 0
+end
+redis.call('ZADD', read, score, ARGV[1])
+for j = 1, tonumber(ARGV[2]) do
+	redis.call('ZREMRANGEBYSCORE', read, ARGV[1 + 2 * j], ARGV[2 + 2 * j])
+end
+local ttl = 0
+for i = n + 1, 2 * n do
+	local t = redis.call('TTL', KEYS[i])
+	if t > ttl then
+		ttl = t
+	end
+end
+if ttl > 0 and redis.call('TTL', read) < ttl then
+	redis.call('EXPIRE', read, ttl)
+end
+return 1
+`)
+
+// 一次统计用户、设备和多个群组的未读数量，群组未读为群组消息数减去已读数
+// KEYS: 用户消息集合... 设备消息集合... 每个群组的群组消息集合... 每个群组的已读集合...，每个来源的key数量相同
+// ARGV: 每个来源的key数量 群组数量 区间数量 min max...
+// 返回{用户未读, 设备未读, 各群组未读...}
+var unreadCountScript = redis.NewScript(-1, `
+local nk, ng, nr = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+
+local function count(first)
+	if nk == 1 then
+		local n = 0
+		for j = 1, nr do
+			n = n + redis.call('ZCOUNT', KEYS[first], ARGV[2 + 2 * j], ARGV[3 + 2 * j])
+		end
+		return n
+	end
+	-- 迁移期间新旧两个集合中可能有同一消息
+	local n, seen = 0, {}
+	for i = first, first + nk - 1 do
+		for j = 1, nr do
+			for _, msgid in ipairs(redis.call('ZRANGEBYSCORE', KEYS[i], ARGV[2 + 2 * j], ARGV[3 + 2 * j])) do
+				if not seen[msgid] then
+					seen[msgid] = true
+					n = n + 1
+				end
+			end
+		end
+	end
+	return n
+end
+
+local ret = {count(1), count(1 + nk)}
+for g = 0, ng - 1 do
+	local n = count(1 + (2 + g) * nk) - count(1 + (2 + ng + g) * nk)
+	if n < 0 then
+		n = 0
+	end
+	ret[#ret + 1] = n
+end
+return ret
+`)
+
+// 未读数量，Groups为各群组的未读数量
+type UnreadCount struct {
+	User   int64
+	Device int64
+	Group  int64
+	Groups map[string]int64
+}
+
+// 所有来源的未读总数
+func (c *UnreadCount) Total() int64 {
+	return c.User + c.Device + c.Group
+}
+
+// 一次往返统计用户消息、设备消息和群组消息的未读数量
+// userid为0、devicekey或userFlag为空时不统计对应的来源
+func (this *Redis) CountUnread(userid int64, devicekey, userFlag string, groups ...string) (_ *UnreadCount, err error) {
+	defer this.guard("CountUnread", &err)
+	rc := this.pool.Get()
+	defer rc.Close()
+
+	if len(userFlag) == 0 {
+		groups = nil
+	}
+
+	schemes := this.readKeys()
+	keys := make(redis.Args, 0, (2+2*len(groups))*len(schemes))
+	for _, k := range schemes {
+		keys = keys.Add(k.User(userid))
+	}
+	for _, k := range schemes {
+		keys = keys.Add(k.Device(devicekey))
+	}
+	for _, group := range groups {
+		for _, k := range schemes {
+			keys = keys.Add(k.Group(group))
+		}
+	}
+	for _, group := range groups {
+		for _, k := range schemes {
+			keys = keys.Add(k.GroupRead(group, userFlag))
+		}
+	}
+
+	args := redis.Args{len(keys)}.AddFlat(keys).Add(len(schemes), len(groups))
+	args = append(args, this.rangeArgs(time.Now(), time.Time{})...)
+
+	counts, err := redis.Values(unreadCountScript.Do(rc, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	ns := make([]int64, len(counts))
+	for i, v := range counts {
+		if ns[i], err = redis.Int64(v, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &UnreadCount{Groups: make(map[string]int64, len(groups))}
+	if userid != 0 {
+		c.User = ns[0]
+	}
+	if len(devicekey) > 0 {
+		c.Device = ns[1]
+	}
+	for i, group := range groups {
+		c.Groups[group] = ns[2+i]
+		c.Group += ns[2+i]
+	}
+
+	return c, nil
+}
+
+// 登记群组消息所属的群组，生存期与标记集合相同
+func (this *Redis) markGroupOf(rc redis.Conn, key, msgid string, ttl int) error {
+	of := this.Keys().GroupOf(msgid)
+	rc.Send("SADD", of, key)
+	rc.Send("EXPIRE", of, ttl)
+	return replyErr(rc.Do(""))
+}
+
+// 在用户的每个群组已读集合中记录标记过的消息，消息所属的群组未登记时不记录
+func (this *Redis) markGroupRead(rc redis.Conn, userFlag, msgid string) error {
+	var groups []string
+	seen := make(map[string]bool)
+	for _, k := range this.readKeys() {
+		res, err := redis.Strings(rc.Do("SMEMBERS", k.GroupOf(msgid)))
+		if err != nil {
+			return err
+		}
+		for _, group := range res {
+			if !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	expired := this.rangeArgs(time.Time{}, time.Now().Add(-time.Millisecond))
+	for _, key := range groups {
+		args := redis.Args{}.AddFlat(this.readKeysOf(func(k KeyScheme) string { return k.Group(key) }))
+		args = args.AddFlat(this.readKeysOf(func(k KeyScheme) string { return k.GroupMark(msgid) }))
+		args = args.Add(this.Keys().GroupRead(key, userFlag))
+		args = append(redis.Args{len(args)}.AddFlat(args).Add(msgid), expired...)
+		if _, err := markGroupReadScript.Do(rc, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}